@@ -0,0 +1,275 @@
+package irc_go
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counters exposed by the admin endpoint's /metrics, kept once EnableMetrics
+// has been called.
+type Metrics struct {
+	BytesIn  uint64
+	BytesOut uint64
+	// Writes that found a peer's send queue full, disconnecting it.
+	SendOverflows uint64
+
+	// How long SendMessage takes to queue a line for a whole channel.
+	FanOut *Histogram
+
+	commands     map[string]*uint64
+	commandsLock sync.RWMutex
+}
+
+// Starts counting traffic for /metrics. Must be called before the server
+// starts serving.
+func (s *Server) EnableMetrics() {
+	s.Metrics = &Metrics{
+		FanOut:   NewHistogram(.00001, .0001, .001, .01, .1, 1),
+		commands: map[string]*uint64{},
+	}
+}
+
+func (m *Metrics) countCommand(name string) {
+	m.commandsLock.RLock()
+	n, ok := m.commands[name]
+	m.commandsLock.RUnlock()
+
+	if !ok {
+		m.commandsLock.Lock()
+		if n, ok = m.commands[name]; !ok {
+			n = new(uint64)
+			m.commands[name] = n
+		}
+		m.commandsLock.Unlock()
+	}
+	atomic.AddUint64(n, 1)
+}
+
+// Counts durations into cumulative buckets, given as upper bounds in
+// seconds, as a Prometheus histogram does.
+type Histogram struct {
+	Buckets []float64
+
+	counts   []uint64
+	count    uint64
+	sumNanos uint64
+}
+
+func NewHistogram(buckets ...float64) *Histogram {
+	return &Histogram{Buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	for i, bound := range h.Buckets {
+		if d.Seconds() <= bound {
+			atomic.AddUint64(&h.counts[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sumNanos, uint64(d))
+}
+
+func (h *Histogram) writeTo(w io.Writer, name string) {
+	total := uint64(0)
+	for i, bound := range h.Buckets {
+		total += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name,
+			strconv.FormatFloat(bound, 'g', -1, 64), total)
+	}
+	count := atomic.LoadUint64(&h.count)
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %g\n", name,
+		time.Duration(atomic.LoadUint64(&h.sumNanos)).Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
+
+// Serves /metrics in the Prometheus text format, and /peers and /rooms as
+// JSON, for mounting on an HTTP server that only operators can reach. Those
+// listening beyond the loopback interface should set AdminToken.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	mux.HandleFunc("/peers", s.servePeers)
+	mux.HandleFunc("/rooms", s.serveRooms)
+	return s.RequireAdminToken(mux)
+}
+
+// Wraps h to refuse requests without "Authorization: Bearer AdminToken",
+// if AdminToken is set, so other debugging handlers can be guarded alike.
+func (s *Server) RequireAdminToken(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.AdminToken != "" {
+			expected := "Bearer " + s.AdminToken
+			given := r.Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(expected)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	gauge := func(name, help string, value int) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n",
+			name, help, name, name, value)
+	}
+	counter := func(name, help string, value uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n",
+			name, help, name, name, value)
+	}
+
+	stats := s.Stats()
+	gauge("irc_connected_clients", "Local connections, registered or not.", stats.Clients)
+	gauge("irc_registered_users", "Users registered on this server.", stats.LocalUsers)
+	gauge("irc_network_users", "Users registered anywhere on the network.", stats.Users)
+	gauge("irc_operators", "IRC operators online.", stats.Operators)
+	gauge("irc_channels", "Channels with at least one member.", stats.Channels)
+	gauge("irc_servers", "Servers on the network, including this one.", stats.Servers)
+
+	queued, deepest := 0, 0
+	s.RLock()
+	for _, p := range s.Peers {
+		n := p.Output.Len()
+		queued += n
+		if n > deepest {
+			deepest = n
+		}
+	}
+	s.RUnlock()
+	gauge("irc_send_queue_lines", "Lines waiting to be sent, across all peers.", queued)
+	gauge("irc_send_queue_max_lines", "Lines waiting for the peer with the most.", deepest)
+
+	m := s.Metrics
+	if m == nil {
+		return
+	}
+	counter("irc_received_bytes_total", "Bytes of commands received.", atomic.LoadUint64(&m.BytesIn))
+	counter("irc_sent_bytes_total", "Bytes queued for sending.", atomic.LoadUint64(&m.BytesOut))
+	counter("irc_send_queue_overflows_total", "Writes that found a full send queue.",
+		atomic.LoadUint64(&m.SendOverflows))
+
+	m.commandsLock.RLock()
+	names := make([]string, 0, len(m.commands))
+	for name := range m.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "# HELP irc_commands_total Commands received, by name.\n")
+	fmt.Fprintf(w, "# TYPE irc_commands_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "irc_commands_total{command=%q} %d\n",
+			name, atomic.LoadUint64(m.commands[name]))
+	}
+	m.commandsLock.RUnlock()
+
+	fmt.Fprintf(w, "# HELP irc_fanout_seconds Time to queue a channel message for every member.\n")
+	fmt.Fprintf(w, "# TYPE irc_fanout_seconds histogram\n")
+	m.FanOut.writeTo(w, "irc_fanout_seconds")
+}
+
+type PeerInfo struct {
+	Key        int      `json:"key"`
+	Nick       string   `json:"nick,omitempty"`
+	User       string   `json:"user,omitempty"`
+	Host       string   `json:"host"`
+	RealName   string   `json:"realname,omitempty"`
+	Account    string   `json:"account,omitempty"`
+	Away       string   `json:"away,omitempty"`
+	Operator   bool     `json:"operator"`
+	Registered bool     `json:"registered"`
+	Link       string   `json:"link,omitempty"`
+	Channels   []string `json:"channels"`
+	// Lines waiting in the peer's send queue.
+	SendQueue int `json:"sendq"`
+}
+
+type RoomInfo struct {
+	Name    string   `json:"name"`
+	Topic   string   `json:"topic"`
+	Modes   string   `json:"modes"`
+	Members []string `json:"members"`
+}
+
+func (s *Server) servePeers(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	channels := map[*Peer][]string{}
+	for name, room := range s.Rooms {
+		room.RLock()
+		for _, member := range room.Members {
+			channels[member.Peer] = append(channels[member.Peer], name)
+		}
+		room.RUnlock()
+	}
+	peers := make([]PeerInfo, 0, len(s.Peers))
+	for _, p := range s.Peers {
+		info := PeerInfo{
+			Key:        p.Key,
+			Nick:       p.Nick,
+			User:       p.User,
+			Host:       p.Host,
+			RealName:   p.FullName,
+			Account:    p.Account,
+			Away:       p.Away,
+			Operator:   p.IsGlobalOperator,
+			Registered: p.SentWelcome,
+			Link:       p.LinkName,
+			Channels:   channels[p],
+			SendQueue:  p.Output.Len(),
+		}
+		if info.Channels == nil {
+			info.Channels = []string{}
+		}
+		sort.Strings(info.Channels)
+		peers = append(peers, info)
+	}
+	s.RUnlock()
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Key < peers[j].Key })
+	writeJSON(w, peers)
+}
+
+func (s *Server) serveRooms(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	rooms := make([]RoomInfo, 0, len(s.Rooms))
+	for name, room := range s.Rooms {
+		room.RLock()
+		info := RoomInfo{
+			Name:    name,
+			Topic:   room.Topic,
+			Modes:   s.channelModes(name, room),
+			Members: make([]string, 0, len(room.Members)),
+		}
+		for _, member := range room.Members {
+			info.Members = append(info.Members,
+				ModePrefixes(room.Modes(member.Peer), true)+member.Nick)
+		}
+		room.RUnlock()
+		sort.Strings(info.Members)
+		rooms = append(rooms, info)
+	}
+	s.RUnlock()
+
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	writeJSON(w, rooms)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,114 @@
+package irc_go_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/fatlotus/fast-irc-golang"
+)
+
+func get(t *testing.T, url string) string {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestAdmin(t *testing.T) {
+	s := NewServer()
+	s.EnableMetrics()
+	admin := httptest.NewServer(s.AdminHandler())
+	defer admin.Close()
+
+	a, err := NewPipeClient("a", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewPipeClient("b", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	a.Join("#chan")
+	b.Join("#chan")
+	a.Writer.WriteString("TOPIC #chan :metrics\r\nPRIVMSG #chan :hi\r\n")
+	a.Writer.Flush()
+	readUntil(t, b, "PRIVMSG #chan :hi")
+
+	metrics := get(t, admin.URL+"/metrics")
+	for _, expected := range []string{
+		"irc_connected_clients 2\n",
+		"irc_registered_users 2\n",
+		"irc_channels 1\n",
+		`irc_commands_total{command="JOIN"} 2` + "\n",
+		`irc_commands_total{command="PRIVMSG"} 1` + "\n",
+		"irc_fanout_seconds_count 1\n",
+		"irc_received_bytes_total ",
+		"irc_sent_bytes_total ",
+		"irc_send_queue_lines ",
+		"irc_send_queue_max_lines ",
+		"# TYPE irc_fanout_seconds histogram\n",
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Errorf("expected %q in metrics:\n%s", expected, metrics)
+		}
+	}
+
+	peers := []PeerInfo{}
+	if err := json.Unmarshal([]byte(get(t, admin.URL+"/peers")), &peers); err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers[0].Nick != "a" || peers[1].Nick != "b" ||
+		!peers[0].Registered || len(peers[0].Channels) != 1 || peers[0].Host != "pipe" {
+		t.Errorf("unexpected peers %+v", peers)
+	}
+
+	rooms := []RoomInfo{}
+	if err := json.Unmarshal([]byte(get(t, admin.URL+"/rooms")), &rooms); err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 1 || rooms[0].Name != "#chan" || rooms[0].Topic != "metrics" ||
+		strings.Join(rooms[0].Members, " ") != "@a b" {
+		t.Errorf("unexpected rooms %+v", rooms)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	s := NewServer()
+	s.AdminToken = "sekrit"
+	admin := httptest.NewServer(s.AdminHandler())
+	defer admin.Close()
+
+	for token, status := range map[string]int{
+		"":       http.StatusUnauthorized,
+		"wrong":  http.StatusUnauthorized,
+		"sekrit": http.StatusOK,
+	} {
+		req, err := http.NewRequest("GET", admin.URL+"/peers", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("expected %d with token %q, got %d", status, token, resp.StatusCode)
+		}
+	}
+}
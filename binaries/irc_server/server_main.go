@@ -1,34 +1,129 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"net/http"
 	_ "net/http/pprof"
 
-	. "github.com/fatlotus/irc_go"
+	. "github.com/fatlotus/fast-irc-golang"
 )
 
 var port = flag.Int("p", 6667, "which port to bind on")
 var password = flag.String("o", "", "operator password")
 var prof = flag.Bool("prof", false, "whether to start a profiler port")
+var admin = flag.String("admin", "", "address for the admin HTTP server (metrics, peers, rooms and pprof)")
+var adminToken = flag.String("admin-token", "", "bearer token the admin HTTP server requires; needed unless it listens on loopback")
 var trace = flag.String("t", "", "path to trace file")
 var motd = flag.String("m", "motd.txt", "message of the day file")
+var config = flag.String("c", "", "path to JSON configuration file")
+var grace = flag.Duration("g", 10*time.Second, "how long to wait for clients on shutdown")
+var handoff = flag.Bool("handoff", false, "whether RESTART keeps clients connected")
+
+// Whether addr only accepts connections from this machine.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Starts a copy of this binary and passes it every connection over a Unix
+// socket, so that clients stay connected across upgrades.
+func handOff(server *Server) error {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return err
+	}
+	parent := os.NewFile(uintptr(fds[0]), "handoff")
+	child := os.NewFile(uintptr(fds[1]), "handoff")
+	defer parent.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		child.Close()
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "IRC_HANDOFF_FD=3")
+	cmd.ExtraFiles = []*os.File{child}
+	err = cmd.Start()
+	child.Close()
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.FileConn(parent)
+	if err == nil {
+		err = server.HandOff(conn.(*net.UnixConn))
+		conn.Close()
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	return err
+}
+
+func takeOver(server *Server, fd string) ([]net.Listener, error) {
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, err
+	}
+	os.Unsetenv("IRC_HANDOFF_FD")
+
+	f := os.NewFile(uintptr(n), "handoff")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return server.TakeOver(conn.(*net.UnixConn))
+}
 
 func main() {
 	flag.Parse()
 
-	if *prof {
-		go func() {
-			log.Println(http.ListenAndServe("localhost:6060", nil))
-		}()
+	if *prof && *admin == "" {
+		*admin = "localhost:6060"
 	}
 
 	server := NewServer()
 
+	if *admin != "" {
+		// /peers lists every user's address, so it mustn't be open to all.
+		if *adminToken == "" && !isLoopback(*admin) {
+			log.Fatalf("-admin %s is reachable from other machines; set -admin-token", *admin)
+		}
+		server.AdminToken = *adminToken
+		server.EnableMetrics()
+		mux := http.NewServeMux()
+		mux.Handle("/", server.AdminHandler())
+		mux.Handle("/debug/pprof/", server.RequireAdminToken(http.DefaultServeMux))
+		go func() {
+			log.Println(http.ListenAndServe(*admin, mux))
+		}()
+	}
+
 	if *trace != "" {
 		fp, err := os.Create(*trace)
 		if err != nil {
@@ -41,8 +136,147 @@ func main() {
 	server.Password = *password
 	server.MessageOfTheDayPath = *motd
 
-	err := server.ListenAndServe(fmt.Sprintf(":%d", *port))
-	if err != nil {
+	addrs := []string{fmt.Sprintf(":%d", *port)}
+	if *config != "" {
+		c, err := LoadConfig(*config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if c.ServerName != "" {
+			server.Name = c.ServerName
+		}
+		if len(c.Listen) > 0 {
+			addrs = c.Listen
+		}
+		server.ConfigPath = *config
+		server.ApplyConfig(c)
+		if c.ChannelStore != "" {
+			err := server.OpenChannelStore(&FileChannelStore{Path: c.ChannelStore})
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if c.AccountStore != "" {
+			grace := 60 * time.Second
+			if c.NickGrace > 0 {
+				grace = time.Duration(c.NickGrace) * time.Second
+			}
+			err := server.EnableNickServ(&FileAccountStore{Path: c.AccountStore}, grace)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if c.ChanServ {
+			server.EnableChanServ()
+		}
+		for _, addr := range c.WebSocketListen {
+			go func(addr string) {
+				log.Println(http.ListenAndServe(addr, server.WebSocketHandler()))
+			}(addr)
+		}
+		if c.HistoryFile != "" {
+			history, err := OpenHistoryFile(c.HistoryFile, c.HistoryLimit)
+			if err != nil {
+				log.Fatal(err)
+			}
+			server.History = history
+		} else if c.HistoryLimit > 0 {
+			server.History = NewHistory(c.HistoryLimit)
+		}
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := server.Rehash(); err != nil {
+					log.Printf("rehash: %s", err)
+				} else {
+					log.Printf("rehashed %s", *config)
+				}
+			}
+		}()
+	}
+
+	// A handoff and a shutdown can both finish, say when SIGTERM arrives
+	// after SIGUSR2, but done may only be closed once.
+	done := make(chan bool)
+	var finish sync.Once
+	finished := func() { finish.Do(func() { close(done) }) }
+	server.OnTerminate = func(restart bool) {
+		if restart && *handoff {
+			if err := handOff(server); err != nil {
+				log.Printf("handoff: %s", err)
+				return
+			}
+			finished()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), *grace)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %s", err)
+		}
+		if restart {
+			exe, err := os.Executable()
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Fatal(syscall.Exec(exe, os.Args, os.Environ()))
+		}
+		finished()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-stop
+		server.OnTerminate(false)
+	}()
+
+	upgrade := make(chan os.Signal, 1)
+	signal.Notify(upgrade, syscall.SIGUSR2)
+	go func() {
+		for range upgrade {
+			if err := handOff(server); err != nil {
+				log.Printf("handoff: %s", err)
+			} else {
+				finished()
+				return
+			}
+		}
+	}()
+
+	listeners := []net.Listener{}
+	if fd := os.Getenv("IRC_HANDOFF_FD"); fd != "" {
+		lns, err := takeOver(server, fd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = lns
+	} else {
+		for _, addr := range addrs {
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				log.Fatal(err)
+			}
+			listeners = append(listeners, ln)
+		}
+	}
+
+	for _, ln := range listeners[1:] {
+		go func(ln net.Listener) {
+			if err := server.ServeListener(ln); err != ErrServerClosed {
+				log.Fatal(err)
+			}
+		}(ln)
+	}
+
+	server.Listener = listeners[0]
+	err := server.Serve()
+	if err == ErrServerClosed {
+		<-done
+	} else if err != nil {
 		log.Fatal(err)
 	}
 }
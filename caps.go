@@ -0,0 +1,243 @@
+package irc_go
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The IRCv3 capabilities we advertise in CAP LS.
+var SupportedCaps = []string{
+	"account-notify",
+	"away-notify",
+	"batch",
+	"chghost",
+	"draft/chathistory",
+	"echo-message",
+	"extended-join",
+	"message-tags",
+	"multi-prefix",
+	"server-time",
+	"userhost-in-names",
+}
+
+const ServerTimeFormat = "2006-01-02T15:04:05.000Z"
+
+var msgIDPrefix = strconv.FormatInt(time.Now().UnixNano(), 36)
+var msgIDCounter uint64
+
+// Returns an ID that is unique across restarts of the server.
+func NewMsgID() string {
+	return formatMsgID(atomic.AddUint64(&msgIDCounter, 1))
+}
+
+func formatMsgID(n uint64) string {
+	return msgIDPrefix + "-" + strconv.FormatUint(n, 36)
+}
+
+func isSupportedCap(name string) bool {
+	for _, c := range SupportedCaps {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Peer) HasCap(name string) bool {
+	p.CapsLock.RLock()
+	defer p.CapsLock.RUnlock()
+	return p.Caps[name]
+}
+
+func (p *Peer) NegotiateCaps(args []string, message string) error {
+	if len(args) == 0 {
+		return &NeedsMoreParams{p.NickOrAsterix(), "CAP"}
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "LS":
+		if !p.SentWelcome {
+			p.CapNegotiating = true
+		}
+		p.CapsLock.Lock()
+		if p.Caps == nil {
+			p.Caps = map[string]bool{}
+		}
+		p.CapsLock.Unlock()
+		p.Say("CAP %s LS :%s", p.NickOrAsterix(), strings.Join(SupportedCaps, " "))
+	case "LIST":
+		enabled := []string{}
+		for _, c := range SupportedCaps {
+			if p.HasCap(c) {
+				enabled = append(enabled, c)
+			}
+		}
+		p.Say("CAP %s LIST :%s", p.NickOrAsterix(), strings.Join(enabled, " "))
+	case "REQ":
+		if !p.SentWelcome {
+			p.CapNegotiating = true
+		}
+		requested := message
+		if len(args) > 1 {
+			requested = strings.Join(args[1:], " ")
+		}
+		changes := strings.Fields(requested)
+		for _, change := range changes {
+			if !isSupportedCap(strings.TrimPrefix(change, "-")) {
+				p.Say("CAP %s NAK :%s", p.NickOrAsterix(), requested)
+				return nil
+			}
+		}
+		p.CapsLock.Lock()
+		if p.Caps == nil {
+			p.Caps = map[string]bool{}
+		}
+		for _, change := range changes {
+			if strings.HasPrefix(change, "-") {
+				delete(p.Caps, change[1:])
+			} else {
+				p.Caps[change] = true
+			}
+		}
+		p.CapsLock.Unlock()
+		p.Say("CAP %s ACK :%s", p.NickOrAsterix(), requested)
+	case "END":
+		p.CapNegotiating = false
+		return p.MaybeSendWelcome()
+	default:
+		return &InvalidCapCommand{p.NickOrAsterix(), args[0]}
+	}
+	return nil
+}
+
+// Formats the tags this peer has asked to receive, including the trailing
+// space, or "" if there are none.
+func (p *Peer) Tags(batch, msgid string, at time.Time) string {
+	p.CapsLock.RLock()
+	defer p.CapsLock.RUnlock()
+
+	if len(p.Caps) == 0 {
+		return ""
+	}
+	tags := ""
+	if batch != "" && p.Caps["batch"] {
+		tags += ";batch=" + batch
+	}
+	if msgid != "" && p.Caps["message-tags"] {
+		tags += ";msgid=" + msgid
+	}
+	if !at.IsZero() && p.Caps["server-time"] {
+		tags += ";time=" + at.UTC().Format(ServerTimeFormat)
+	}
+	if tags == "" {
+		return ""
+	}
+	return "@" + tags[1:] + " "
+}
+
+// Like SayFrom, but prefixed with the given message tags.
+func (p *Peer) SayTagged(tags, source, format string, args ...interface{}) {
+	p.Write(tags + ":" + source + fmt.Sprintf(" "+format+"\r\n", args...))
+}
+
+// A message relayed to several peers at once, all of whom should see the
+// same msgid and time. The msgid is only formatted if someone asks for it.
+type Relay struct {
+	Seq  uint64
+	Time time.Time
+}
+
+func NewRelay() Relay {
+	return Relay{atomic.AddUint64(&msgIDCounter, 1), time.Now()}
+}
+
+func (r Relay) ID() string {
+	return formatMsgID(r.Seq)
+}
+
+// Sends the message to p alone, tagged as far as p has asked for.
+func (r Relay) Send(p *Peer, source, format string, args ...interface{}) {
+	line := r.Line(source, format, args...)
+	line.SendTo(p)
+	line.Release()
+}
+
+// Encodes the message for sending to any number of peers, all of whom will
+// see this relay's msgid and time.
+func (r Relay) Line(source, format string, args ...interface{}) *Line {
+	body := newSharedBuf()
+	body.b = encodeLine(body.b, source, format, args...)
+	return &Line{
+		Relay: r,
+		body:  body,
+	}
+}
+
+func encodeLine(buf []byte, source, format string, args ...interface{}) []byte {
+	buf = append(append(append(buf, ':'), source...), ' ')
+	buf = fmt.Appendf(buf, format, args...)
+	return append(buf, '\r', '\n')
+}
+
+// A message encoded once and shared by every recipient, rather than
+// formatted and copied for each. Recipients that want message tags get a
+// tagged copy, of which there is one per distinct set of tags. A Line is not
+// safe for concurrent use, but once written its buffers are never modified.
+//
+// The buffers are reference counted: each send queue holds them until it
+// has written them, and the Line itself until Release, after which they are
+// reused for other lines. A Line that is never released is simply left to
+// the garbage collector.
+type Line struct {
+	Relay
+	Batch string
+
+	id     string
+	body   *sharedBuf
+	tagged map[string]*sharedBuf
+}
+
+func (l *Line) ID() string {
+	if l.id == "" {
+		l.id = l.Relay.ID()
+	}
+	return l.id
+}
+
+func (l *Line) SendTo(p *Peer) {
+	p.CapsLock.RLock()
+	plain := len(p.Caps) == 0
+	p.CapsLock.RUnlock()
+	if plain {
+		p.writeShared(l.body)
+		return
+	}
+
+	tags := p.Tags(l.Batch, l.ID(), l.Time)
+	if tags == "" {
+		p.writeShared(l.body)
+		return
+	}
+	buf, ok := l.tagged[tags]
+	if !ok {
+		if l.tagged == nil {
+			l.tagged = map[string]*sharedBuf{}
+		}
+		buf = newSharedBuf()
+		buf.b = append(append(buf.b, tags...), l.body.b...)
+		l.tagged[tags] = buf
+	}
+	p.writeShared(buf)
+}
+
+// Lets go of the line's buffers. It must not be sent again afterwards.
+func (l *Line) Release() {
+	l.body.release()
+	for _, buf := range l.tagged {
+		buf.release()
+	}
+	l.body, l.tagged = nil, nil
+}
@@ -0,0 +1,195 @@
+package irc_go_test
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/fatlotus/fast-irc-golang"
+)
+
+func msgidOf(t *testing.T, line string) string {
+	if !strings.HasPrefix(line, "@") || !strings.Contains(line, "time=") {
+		t.Fatalf("expected server-time and msgid tags on %q", line)
+	}
+	parts := strings.SplitN(line, "msgid=", 2)
+	if len(parts) != 2 {
+		t.Fatalf("expected a msgid on %q", line)
+	}
+	return strings.FieldsFunc(parts[1], func(r rune) bool {
+		return r == ';' || r == ' '
+	})[0]
+}
+
+func TestRelayTags(t *testing.T) {
+	s := NewServer()
+	if err := s.Listen("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Listener.Close()
+	go s.Serve()
+	addr := s.Listener.Addr().String()
+
+	clients := []*Client{}
+	for _, nick := range []string{"a", "b"} {
+		c, err := NewClient(nick, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		fmt.Fprintf(c.Writer, "CAP REQ :message-tags server-time\r\n")
+		c.Join("#chan")
+		clients = append(clients, c)
+	}
+	a, b := clients[0], clients[1]
+	msgidOf(t, readUntil(t, a, "JOIN #chan"))
+
+	// Everyone sees the same ID for the same event.
+	fmt.Fprintf(a.Writer, "TOPIC #chan :tagged\r\n")
+	a.Writer.Flush()
+	first := msgidOf(t, readUntil(t, a, "TOPIC #chan"))
+	if second := msgidOf(t, readUntil(t, b, "TOPIC #chan")); first != second {
+		t.Errorf("expected matching msgids, got %q and %q", first, second)
+	}
+
+	fmt.Fprintf(b.Writer, "PART #chan\r\n")
+	b.Writer.Flush()
+	if msgidOf(t, readUntil(t, a, "PART #chan")) == first {
+		t.Errorf("expected a fresh msgid for each event")
+	}
+
+	// Clients that haven't asked for tags don't get them.
+	c, err := NewClient("c", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Join("#chan")
+	fmt.Fprintf(a.Writer, "MODE #chan +m\r\n")
+	a.Writer.Flush()
+	if line := readUntil(t, c, "MODE #chan"); strings.HasPrefix(line, "@") {
+		t.Errorf("unexpected tags on %q", line)
+	}
+}
+
+func TestStateSync(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	s := NewServer()
+	s.Password = "sekrit"
+	store := &FileAccountStore{Path: tmpdir + "/accounts.json"}
+	if err := s.EnableNickServ(store, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Listen("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Listener.Close()
+	go s.Serve()
+	addr := s.Listener.Addr().String()
+
+	a, err := NewClient("a", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	fmt.Fprintf(a.Writer, "CAP REQ :account-notify away-notify chghost extended-join\r\n")
+	a.Join("#chan")
+
+	b, err := NewClient("b", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fmt.Fprintf(b.Writer, "CAP REQ echo-message\r\n")
+	b.Join("#chan")
+	readUntil(t, a, "JOIN #chan * :b")
+
+	b.PrivMsg("#chan", "hello")
+	b.Writer.Flush()
+	readUntil(t, b, "PRIVMSG #chan :hello")
+
+	fmt.Fprintf(b.Writer, "AWAY :lunch\r\nAWAY\r\n")
+	b.Writer.Flush()
+	readUntil(t, a, "AWAY :lunch")
+	if line := readUntil(t, a, "AWAY"); strings.Contains(line, "lunch") {
+		t.Errorf("expected b to be back, got %q", line)
+	}
+
+	fmt.Fprintf(b.Writer, "PRIVMSG NickServ :REGISTER hunter2\r\n")
+	b.Writer.Flush()
+	readUntil(t, a, "ACCOUNT b")
+
+	fmt.Fprintf(a.Writer, "OPER a sekrit\r\nCHGHOST b bee example.com\r\n")
+	a.Writer.Flush()
+	readUntil(t, a, "CHGHOST bee example.com")
+
+	// Clients without chghost see the user rejoin under the new host.
+	fmt.Fprintf(a.Writer, "CHGHOST a ay example.org\r\n")
+	a.Writer.Flush()
+	readUntil(t, b, "QUIT :Changing host")
+	readUntil(t, b, ":a!ay@example.org JOIN #chan")
+	readUntil(t, b, "MODE #chan +o a")
+}
+
+func TestPrefixes(t *testing.T) {
+	s := NewServer()
+	if err := s.Listen("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Listener.Close()
+	go s.Serve()
+	addr := s.Listener.Addr().String()
+
+	a, err := NewClient("a", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	a.Join("#chan")
+
+	// Negotiate capabilities before registering, as real clients do.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Client{Conn: conn, Reader: bufio.NewReader(conn), Writer: bufio.NewWriter(conn)}
+	defer b.Close()
+	fmt.Fprintf(b.Writer, "CAP LS\r\nNICK b\r\nUSER b * * :b\r\n")
+	fmt.Fprintf(b.Writer, "CAP REQ :multi-prefix userhost-in-names\r\nCAP END\r\n")
+	b.Writer.Flush()
+	readUntil(t, b, "PREFIX=(qaohv)~&@%+")
+	b.Join("#chan")
+
+	fmt.Fprintf(a.Writer, "MODE #chan +v b\r\nMODE #chan +h b\r\n")
+	a.Writer.Flush()
+	readUntil(t, b, "MODE #chan +h b")
+
+	fmt.Fprintf(b.Writer, "NAMES #chan\r\n")
+	b.Writer.Flush()
+	line := readUntil(t, b, "353")
+	if !strings.Contains(line, "@a!a@") || !strings.Contains(line, "%+b!b@") {
+		t.Errorf("unexpected NAMES reply %q", line)
+	}
+
+	// Half-ops can voice, but not op.
+	fmt.Fprintf(b.Writer, "MODE #chan +o b\r\nMODE #chan -v b\r\n")
+	b.Writer.Flush()
+	readUntil(t, b, "482 b #chan")
+	readUntil(t, b, "MODE #chan -v b")
+
+	fmt.Fprintf(a.Writer, "WHO #chan\r\n")
+	a.Writer.Flush()
+	if line := readUntil(t, a, "352 a #chan 2 3 4 b"); !strings.Contains(line, "H%") {
+		t.Errorf("expected a single half-op prefix, got %q", line)
+	}
+}
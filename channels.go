@@ -0,0 +1,269 @@
+package irc_go
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Standing privilege levels in a registered channel's access list.
+const (
+	AccessNone = iota
+	AccessVoice
+	AccessOp
+	AccessFounder
+)
+
+// The saved state of a registered channel, which outlives the Room itself.
+type ChannelRecord struct {
+	Founder    string
+	Registered time.Time
+
+	Topic        string
+	TopicSetter  string
+	TopicTime    time.Time
+	IsModerated  bool
+	IsFixedTopic bool
+	IsSecret     bool
+	IsPrivate    bool
+	// Stored inverted, so that records saved before -n existed keep +n.
+	AllowsExternal bool
+	Bans           []string
+
+	// Privileges granted on join, keyed either by account (by nick when
+	// NickServ isn't running) or by a nick!user@host mask.
+	Access map[string]int
+}
+
+// Persists registered channels across restarts. Save may be called for
+// different channels at once.
+type ChannelStore interface {
+	Load() (map[string]*ChannelRecord, error)
+	Save(name string, record *ChannelRecord) error
+	Delete(name string) error
+}
+
+// Stores every registered channel in a single JSON file, which is rewritten
+// (atomically, via rename) on each change.
+type FileChannelStore struct {
+	Path    string
+	records map[string]*ChannelRecord
+	sync.Mutex
+}
+
+func (f *FileChannelStore) Load() (map[string]*ChannelRecord, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.records = map[string]*ChannelRecord{}
+	buf, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return f.records, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &f.records); err != nil {
+		return nil, err
+	}
+	return f.records, nil
+}
+
+func (f *FileChannelStore) Save(name string, record *ChannelRecord) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.records == nil {
+		f.records = map[string]*ChannelRecord{}
+	}
+	// Copy everything, since the caller may go on to change the record
+	// while another channel is being saved.
+	copy := *record
+	copy.Bans = append([]string(nil), record.Bans...)
+	copy.Access = map[string]int{}
+	for key, level := range record.Access {
+		copy.Access[key] = level
+	}
+	f.records[name] = &copy
+	return f.flush()
+}
+
+func (f *FileChannelStore) Delete(name string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	delete(f.records, name)
+	return f.flush()
+}
+
+func (f *FileChannelStore) flush() error {
+	return writeJSONFile(f.Path, f.records)
+}
+
+// Replaces the file with the JSON encoding of v, so that readers never see a
+// partially written file.
+func writeJSONFile(path string, v interface{}) error {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Installs the store and loads the channels registered in it.
+func (s *Server) OpenChannelStore(store ChannelStore) error {
+	records, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.ChannelStore = store
+	s.Registered = records
+	return nil
+}
+
+// Registers the room to sender, who must have identified if NickServ is
+// running, whether asked through ChanServ or with MODE +r.
+func (s *Server) RegisterChannel(sender *Peer, name string, room *Room) error {
+	if s.identity(sender) == "" {
+		return &NeedsIdentification{sender.Nick, name}
+	}
+	if _, ok := s.Registered[name]; ok {
+		return &ChannelAlreadyRegistered{sender.Nick, name}
+	}
+	s.Registered[name] = &ChannelRecord{
+		Founder:    s.identity(sender),
+		Registered: time.Now(),
+		Access:     map[string]int{},
+	}
+	s.saveRoom(name, room)
+	return nil
+}
+
+func (s *Server) UnregisterChannel(sender *Peer, name string) error {
+	record, ok := s.Registered[name]
+	if !ok {
+		return nil
+	}
+	if s.accessLevel(record, sender) < AccessFounder && !sender.IsGlobalOperator {
+		return &NotOperator{sender.Nick, name}
+	}
+	delete(s.Registered, name)
+	if s.ChannelStore != nil {
+		if err := s.ChannelStore.Delete(name); err != nil {
+			log.Printf("deleting %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// Records the current state of the room, if it is registered. Must be called
+// with the server at least read-locked and the room locked.
+func (s *Server) saveRoom(name string, room *Room) {
+	s.registryLock.Lock()
+	defer s.registryLock.Unlock()
+
+	record, ok := s.Registered[name]
+	if !ok {
+		return
+	}
+	record.Topic = room.Topic
+	record.TopicSetter = room.TopicSetter
+	record.TopicTime = room.TopicTime
+	record.IsModerated = room.IsModerated
+	record.IsFixedTopic = room.IsFixedTopic
+	record.IsSecret = room.IsSecret
+	record.IsPrivate = room.IsPrivate
+	record.AllowsExternal = room.AllowsExternal
+	record.Bans = append([]string(nil), room.Bans...)
+
+	if s.ChannelStore != nil {
+		if err := s.ChannelStore.Save(name, record); err != nil {
+			log.Printf("saving %s: %s", name, err)
+		}
+	}
+}
+
+// Grants or revokes the peer's standing operator access to a registered
+// channel. Must be called with the server at least read-locked and the room
+// locked.
+func (s *Server) saveAccess(name string, p *Peer, op bool) {
+	s.registryLock.Lock()
+	defer s.registryLock.Unlock()
+
+	record, ok := s.Registered[name]
+	id := s.identity(p)
+	if !ok || id == "" || id == record.Founder {
+		return
+	}
+	if record.Access == nil {
+		record.Access = map[string]int{}
+	}
+	if op {
+		record.Access[id] = AccessOp
+	} else if record.Access[id] == AccessOp {
+		delete(record.Access, id)
+	}
+
+	if s.ChannelStore != nil {
+		if err := s.ChannelStore.Save(name, record); err != nil {
+			log.Printf("saving %s: %s", name, err)
+		}
+	}
+}
+
+// The name a peer's channel access is keyed by: their account when NickServ
+// is running, and otherwise their nick.
+func (s *Server) identity(p *Peer) string {
+	if s.NickServ != nil {
+		return p.Account
+	}
+	return p.Nick
+}
+
+func (s *Server) accessLevel(record *ChannelRecord, p *Peer) int {
+	id := s.identity(p)
+	if id != "" && id == record.Founder {
+		return AccessFounder
+	}
+	level := AccessNone
+	for key, granted := range record.Access {
+		matches := false
+		if strings.ContainsAny(key, "!@") {
+			matches = MatchMask(key, p.Hostmask())
+		} else {
+			matches = id != "" && key == id
+		}
+		if matches && granted > level {
+			level = granted
+		}
+	}
+	return level
+}
+
+// Builds a fresh room from a registered channel's record.
+func (record *ChannelRecord) NewRoom() *Room {
+	return &Room{
+		Members:      map[int]*Member{},
+		Created:      time.Now(),
+		Topic:        record.Topic,
+		TopicSetter:  record.TopicSetter,
+		TopicTime:    record.TopicTime,
+		IsModerated:  record.IsModerated,
+		IsFixedTopic: record.IsFixedTopic,
+		IsSecret:     record.IsSecret,
+		IsPrivate:    record.IsPrivate,
+		Bans:         append([]string(nil), record.Bans...),
+
+		AllowsExternal: record.AllowsExternal,
+	}
+}
@@ -0,0 +1,116 @@
+package irc_go_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/fatlotus/fast-irc-golang"
+)
+
+func register(t *testing.T, s *Server, nick string) *Peer {
+	p := attach(t, s)
+	if err := p.Route("NICK", []string{nick}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Route("USER", []string{nick, "*", "*"}, nick); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestRegisteredChannelSurvivesRestart(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "channels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	path := tmpdir + "/channels.json"
+
+	s := NewServer()
+	if err := s.OpenChannelStore(&FileChannelStore{Path: path}); err != nil {
+		t.Fatal(err)
+	}
+	founder := register(t, s, "founder")
+	helper := register(t, s, "helper")
+	must := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(s.Join(founder, "#saved"))
+	must(s.Join(helper, "#saved"))
+	must(s.SetMode(founder, "#saved", "+r"))
+	must(s.SetMode(founder, "#saved", "+t"))
+	must(s.SetTopic(founder, "#saved", "still here"))
+	must(s.SetMembershipMode(founder, "#saved", "+o", "helper"))
+	must(s.SetMembershipMode(founder, "#saved", "+b", "*!*@spammer"))
+	must(s.Part(founder, "#saved", ""))
+	must(s.Part(helper, "#saved", ""))
+
+	if _, ok := s.Rooms["#saved"]; ok {
+		t.Errorf("expected the empty room to be removed")
+	}
+
+	// Start over with a fresh server reading the same file.
+	s = NewServer()
+	if err := s.OpenChannelStore(&FileChannelStore{Path: path}); err != nil {
+		t.Fatal(err)
+	}
+	stranger := register(t, s, "stranger")
+	helper = register(t, s, "helper")
+
+	must(s.Join(stranger, "#saved"))
+	room := s.Rooms["#saved"]
+	if room == nil {
+		t.Fatal("expected the room to be recreated")
+	}
+	if room.Topic != "still here" || !room.IsFixedTopic {
+		t.Errorf("expected the topic and +t to be restored, got %#v", room)
+	}
+	if len(room.Bans) != 1 || room.Bans[0] != "*!*@spammer" {
+		t.Errorf("expected the ban list to be restored, got %#v", room.Bans)
+	}
+	if IsModerator(stranger, "#saved") {
+		t.Errorf("the first user to join a registered channel should not get ops")
+	}
+
+	must(s.Join(helper, "#saved"))
+	if !IsModerator(helper, "#saved") {
+		t.Errorf("expected helper to be given ops")
+	}
+}
+
+func TestPartDropsPrivileges(t *testing.T) {
+	s := NewServer()
+	alice := register(t, s, "alice")
+	bob := register(t, s, "bob")
+	for _, p := range []*Peer{alice, bob} {
+		if err := s.Join(p, "#chan"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SetMembershipMode(alice, "#chan", "+v", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMembershipMode(alice, "#chan", "+h", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if modes := s.Rooms["#chan"].Modes(bob); modes != "hv" {
+		t.Errorf("expected bob to be +hv, got %q", modes)
+	}
+
+	// Leaving the channel forgets everything granted in it.
+	if err := s.Part(alice, "#chan", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Join(alice, "#chan"); err != nil {
+		t.Fatal(err)
+	}
+	if IsModerator(alice, "#chan") {
+		t.Errorf("alice should have lost ops by parting")
+	}
+	if err := s.SetMembershipMode(alice, "#chan", "-v", "bob"); err == nil {
+		t.Errorf("expected alice to need ops")
+	}
+}
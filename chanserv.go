@@ -0,0 +1,201 @@
+package irc_go
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+const chanServSource = "ChanServ!ChanServ@services"
+
+var accessLevelNames = map[int]string{
+	AccessVoice:   "voice",
+	AccessOp:      "op",
+	AccessFounder: "founder",
+}
+
+// Lets channel founders register a channel and keep a list of who should be
+// opped or voiced on join.
+type ChanServ struct {
+	Server *Server
+}
+
+func (s *Server) EnableChanServ() {
+	s.Lock()
+	defer s.Unlock()
+
+	c := &ChanServ{Server: s}
+	s.ChanServ = c
+	s.addService("ChanServ", "Channel Services", c)
+}
+
+func (c *ChanServ) reply(p *Peer, format string, args ...interface{}) {
+	p.SayFrom(chanServSource, "NOTICE %s :%s", p.Nick, fmt.Sprintf(format, args...))
+}
+
+func (c *ChanServ) Handle(sender *Peer, message string) {
+	c.Server.Lock()
+	defer c.Server.Unlock()
+
+	words := strings.Fields(message)
+	if len(words) < 2 {
+		c.reply(sender, "Available commands: REGISTER, DROP, ACCESS, INFO")
+		return
+	}
+
+	name := words[1]
+	switch strings.ToUpper(words[0]) {
+	case "REGISTER":
+		c.register(sender, name)
+	case "DROP":
+		c.drop(sender, name)
+	case "ACCESS":
+		c.access(sender, name, words[2:])
+	case "INFO":
+		c.info(sender, name)
+	default:
+		c.reply(sender, "Unknown command %s. Available commands: REGISTER, DROP, ACCESS, INFO", words[0])
+	}
+}
+
+func (c *ChanServ) register(sender *Peer, name string) {
+	s := c.Server
+	room, ok := s.Rooms[name]
+	if !ok || !room.ContainsMember(sender) {
+		c.reply(sender, "You must be in %s to register it.", name)
+		return
+	}
+	if !IsModerator(sender, name) {
+		c.reply(sender, "You must be a channel operator in %s to register it.", name)
+		return
+	}
+	if err := s.RegisterChannel(sender, name, room); err != nil {
+		if _, ok := err.(*NeedsIdentification); ok {
+			c.reply(sender, "You must identify to NickServ before registering a channel.")
+		} else {
+			c.reply(sender, "%s is already registered.", name)
+		}
+		return
+	}
+
+	c.reply(sender, "%s is now registered to %s.", name, s.identity(sender))
+	line := NewRelay().Line(chanServSource, "MODE %s +r", name)
+	defer line.Release()
+	for _, member := range room.Members {
+		line.SendTo(member.Peer)
+	}
+}
+
+func (c *ChanServ) drop(sender *Peer, name string) {
+	s := c.Server
+	if _, ok := s.Registered[name]; !ok {
+		c.reply(sender, "%s is not registered.", name)
+		return
+	}
+	if err := s.UnregisterChannel(sender, name); err != nil {
+		c.reply(sender, "Only the founder of %s can drop it.", name)
+		return
+	}
+
+	c.reply(sender, "%s has been dropped.", name)
+	if room, ok := s.Rooms[name]; ok {
+		line := NewRelay().Line(chanServSource, "MODE %s -r", name)
+		defer line.Release()
+		for _, member := range room.Members {
+			line.SendTo(member.Peer)
+		}
+	}
+}
+
+func (c *ChanServ) access(sender *Peer, name string, args []string) {
+	s := c.Server
+	record, ok := s.Registered[name]
+	if !ok {
+		c.reply(sender, "%s is not registered.", name)
+		return
+	}
+	level := s.accessLevel(record, sender)
+	if sender.IsGlobalOperator {
+		level = AccessFounder
+	}
+
+	if len(args) == 0 || strings.ToUpper(args[0]) == "LIST" {
+		if level < AccessOp {
+			c.reply(sender, "Access denied.")
+			return
+		}
+		keys := []string{}
+		for key := range record.Access {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		c.reply(sender, "Access list for %s:", name)
+		c.reply(sender, "%s founder", record.Founder)
+		for _, key := range keys {
+			c.reply(sender, "%s %s", key, accessLevelNames[record.Access[key]])
+		}
+		c.reply(sender, "End of access list.")
+		return
+	}
+
+	if level < AccessFounder {
+		c.reply(sender, "Only the founder of %s can change its access list.", name)
+		return
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "ADD":
+		if len(args) != 3 {
+			c.reply(sender, "Syntax: ACCESS <channel> ADD <account|mask> <op|voice>")
+			return
+		}
+		granted := AccessNone
+		switch strings.ToLower(args[2]) {
+		case "op":
+			granted = AccessOp
+		case "voice":
+			granted = AccessVoice
+		default:
+			c.reply(sender, "Unknown access level %s; use op or voice.", args[2])
+			return
+		}
+		if record.Access == nil {
+			record.Access = map[string]int{}
+		}
+		record.Access[args[1]] = granted
+		c.reply(sender, "%s now has %s access to %s.", args[1], args[2], name)
+	case "DEL":
+		if len(args) != 2 {
+			c.reply(sender, "Syntax: ACCESS <channel> DEL <account|mask>")
+			return
+		}
+		if _, ok := record.Access[args[1]]; !ok {
+			c.reply(sender, "%s is not on the access list for %s.", args[1], name)
+			return
+		}
+		delete(record.Access, args[1])
+		c.reply(sender, "%s has been removed from the access list for %s.", args[1], name)
+	default:
+		c.reply(sender, "Syntax: ACCESS <channel> [LIST|ADD|DEL] ...")
+		return
+	}
+
+	if s.ChannelStore != nil {
+		if err := s.ChannelStore.Save(name, record); err != nil {
+			log.Printf("saving %s: %s", name, err)
+		}
+	}
+}
+
+func (c *ChanServ) info(sender *Peer, name string) {
+	record, ok := c.Server.Registered[name]
+	if !ok {
+		c.reply(sender, "%s is not registered.", name)
+		return
+	}
+	c.reply(sender, "Information on %s:", name)
+	c.reply(sender, "Founder: %s", record.Founder)
+	c.reply(sender, "Registered: %s", record.Registered.Format(time.RFC1123))
+}
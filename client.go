@@ -53,12 +53,26 @@ func NewClient(nick, addr string) (*Client, error) {
 		return nil, err
 	}
 	conn.(*net.TCPConn).SetNoDelay(true)
-	fmt.Fprintf(conn, "NICK %s\r\nUSER %s * * :%s\r\n", nick, nick, nick)
+	return register(nick, conn), nil
+}
+
+// Connects a client to s over an in-memory pipe rather than TCP.
+func NewPipeClient(nick string, s *Server) (*Client, error) {
+	conn, err := s.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	return register(nick, conn), nil
+}
+
+func register(nick string, conn net.Conn) *Client {
 	c := &Client{
 		Conn:   conn,
 		Reader: bufio.NewReader(conn),
 		Writer: bufio.NewWriter(conn),
 	}
+	fmt.Fprintf(c.Writer, "NICK %s\r\nUSER %s * * :%s\r\n", nick, nick, nick)
+	c.Writer.Flush()
 	for {
 		line, err := c.Reader.ReadString('\n')
 		if err != nil {
@@ -68,5 +82,5 @@ func NewClient(nick, addr string) (*Client, error) {
 			break
 		}
 	}
-	return c, nil
+	return c
 }
@@ -0,0 +1,360 @@
+package irc_go
+
+import (
+	"strings"
+)
+
+// Handles one command from a peer. Any error is sent back to the peer as
+// the reply, so should be one of the numerics in errors.go.
+type CommandHandler func(p *Peer, args []string, message string) error
+
+// A command peers may send. Route answers on its behalf when the peer has
+// not yet registered (if Registered is set) or gave fewer than MinParams
+// parameters, so Handler needn't check either. Commands from unregistered
+// peers are ignored, or with RejectUnregistered set, answered with 451. An
+// empty trailing parameter, as in "TOPIC #chan :", is usually
+// indistinguishable from none; with EmptyTrailing set, it's passed as a
+// final empty arg instead.
+type Command struct {
+	Name               string
+	MinParams          int
+	Registered         bool
+	RejectUnregistered bool
+	EmptyTrailing      bool
+	Handler            CommandHandler
+}
+
+// Adds a command, or replaces the built-in one of the same name. Must be
+// called before the server starts serving.
+func (s *Server) AddCommand(c *Command) {
+	s.Commands[c.Name] = c
+}
+
+func (p *Peer) IsRegistered() bool {
+	return p.Nick != "" && p.User != ""
+}
+
+func defaultCommands() map[string]*Command {
+	commands := map[string]*Command{}
+	for _, c := range []*Command{
+		{Name: "NICK", Handler: cmdNick},
+		{Name: "USER", MinParams: 3, Handler: cmdUser},
+		{Name: "CAP", Handler: cmdCap},
+		{Name: "PASS", Handler: cmdPass},
+		{Name: "SERVER", Handler: cmdServer},
+		{Name: "CHATHISTORY", Registered: true, Handler: cmdChatHistory},
+		{Name: "NICKSERV", Handler: cmdNickServ("NICKSERV")},
+		{Name: "NS", Handler: cmdNickServ("NS")},
+		{Name: "MOTD", Handler: cmdMotd},
+		{Name: "PRIVMSG", Registered: true, RejectUnregistered: true, Handler: cmdMessage("PRIVMSG")},
+		{Name: "NOTICE", Registered: true, RejectUnregistered: true, Handler: cmdMessage("NOTICE")},
+		{Name: "AWAY", Registered: true, Handler: cmdAway},
+		{Name: "JOIN", Registered: true, MinParams: 1, Handler: cmdJoin},
+		{Name: "PART", Registered: true, MinParams: 1, Handler: cmdPart},
+		{Name: "NAMES", Registered: true, Handler: cmdNames},
+		{Name: "LIST", Registered: true, Handler: cmdList},
+		{Name: "WHO", Registered: true, MinParams: 1, Handler: cmdWho},
+		{Name: "MODE", Registered: true, MinParams: 1, Handler: cmdMode},
+		{Name: "TOPIC", Registered: true, MinParams: 1, EmptyTrailing: true, Handler: cmdTopic},
+		{Name: "PING", Handler: cmdPing},
+		{Name: "PONG", Handler: cmdPong},
+		{Name: "LUSERS", Handler: cmdLusers},
+		{Name: "OPER", Registered: true, MinParams: 2, Handler: cmdOper},
+		{Name: "REHASH", Registered: true, Handler: cmdRehash},
+		{Name: "DIE", Registered: true, Handler: cmdTerminate(false)},
+		{Name: "RESTART", Registered: true, Handler: cmdTerminate(true)},
+		{Name: "CHGHOST", Registered: true, Handler: cmdChangeHost},
+		{Name: "LINKS", Registered: true, Handler: cmdLinks},
+		{Name: "MAP", Registered: true, Handler: cmdMap},
+		{Name: "CONNECT", Registered: true, Handler: cmdConnect},
+		{Name: "SQUIT", Registered: true, Handler: cmdSquit},
+		{Name: "WALLOPS", Registered: true, Handler: cmdWallops},
+		{Name: "WHOIS", Handler: cmdWhois},
+		{Name: "QUIT", Handler: cmdQuit},
+	} {
+		commands[c.Name] = c
+	}
+	return commands
+}
+
+func cmdNick(p *Peer, args []string, message string) error {
+	if len(args) == 0 {
+		return &NoNickSpecified{}
+	}
+	if err := p.Server.SetNick(p, args[0]); err != nil {
+		return err
+	}
+	return p.MaybeSendWelcome()
+}
+
+func cmdUser(p *Peer, args []string, message string) error {
+	if message == "" {
+		return &NeedsMoreParams{p.NickOrAsterix(), "USER"}
+	}
+	p.User = args[0]
+	p.FullName = message
+	return p.MaybeSendWelcome()
+}
+
+func cmdCap(p *Peer, args []string, message string) error {
+	return p.NegotiateCaps(args, message)
+}
+
+func cmdPass(p *Peer, args []string, message string) error {
+	if p.SentWelcome {
+		return &UnknownCommand{p.NickOrAsterix(), "PASS"}
+	}
+	if len(args) == 0 {
+		return &NeedsMoreParams{p.NickOrAsterix(), "PASS"}
+	}
+	p.Password = args[0]
+	return nil
+}
+
+func cmdServer(p *Peer, args []string, message string) error {
+	if p.SentWelcome {
+		return &UnknownCommand{p.NickOrAsterix(), "SERVER"}
+	}
+	if len(args) < 2 {
+		return &NeedsMoreParams{p.NickOrAsterix(), "SERVER"}
+	}
+	if p.Nick == "" && p.User == "" {
+		return p.Server.AcceptLink(p, args[0], message)
+	}
+	return nil
+}
+
+func cmdChatHistory(p *Peer, args []string, message string) error {
+	return p.Server.ChatHistory(p, chatHistoryParams(args, message))
+}
+
+func cmdNickServ(cmd string) CommandHandler {
+	return func(p *Peer, args []string, message string) error {
+		if p.IsRegistered() && p.Server.NickServ != nil {
+			p.Server.NickServ.Handle(p, strings.Join(append(args, message), " "))
+			return nil
+		}
+		if p.SentWelcome {
+			return &UnknownCommand{p.NickOrAsterix(), cmd}
+		}
+		return nil
+	}
+}
+
+func cmdMotd(p *Peer, args []string, message string) error {
+	p.SendMotd()
+	return nil
+}
+
+func cmdMessage(cmd string) CommandHandler {
+	return func(p *Peer, args []string, message string) error {
+		err := error(nil)
+		if len(args) == 0 {
+			err = &NoRecipient{p.NickOrAsterix()}
+		} else if message == "" {
+			err = &NoMessage{p.NickOrAsterix()}
+		} else {
+			err = p.Server.deliver(p, cmd, args[0], message)
+		}
+		if cmd == "PRIVMSG" && err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
+func cmdAway(p *Peer, args []string, message string) error {
+	p.Server.SetAway(p, message)
+	if message != "" {
+		p.Say("306 %s :You have been marked as being away", p.Nick)
+	} else {
+		p.Say("305 %s :You are no longer marked as being away", p.Nick)
+	}
+	return nil
+}
+
+func cmdJoin(p *Peer, args []string, message string) error {
+	if len(args) != 1 {
+		return &NeedsMoreParams{p.Nick, "JOIN"}
+	}
+	added, err := p.Server.join(p, args[0])
+	if added {
+		p.Server.joined(p, args[0])
+	}
+	return err
+}
+
+func cmdPart(p *Peer, args []string, message string) error {
+	if len(args) != 1 {
+		return &NeedsMoreParams{p.Nick, "PART"}
+	}
+	return p.Server.Part(p, args[0], message)
+}
+
+func cmdNames(p *Peer, args []string, message string) error {
+	if len(args) == 1 {
+		return p.Server.SendNames(p, args[0])
+	}
+	return p.Server.SendAllNames(p)
+}
+
+func cmdList(p *Peer, args []string, message string) error {
+	// Any second parameter names a server, which can only be this one.
+	if len(args) > 0 {
+		return p.Server.ListChannels(p, args[0])
+	}
+	return p.Server.ListChannels(p, message)
+}
+
+func cmdWho(p *Peer, args []string, message string) error {
+	if len(args) != 1 {
+		return &NeedsMoreParams{p.Nick, "WHO"}
+	}
+	if args[0] == "*" {
+		return p.Server.WhoAll(p)
+	}
+	return p.Server.Who(p, args[0])
+}
+
+func cmdMode(p *Peer, args []string, message string) error {
+	switch len(args) {
+	case 3:
+		return p.Server.SetMembershipMode(p, args[0], args[1], args[2])
+	case 2:
+		return p.Server.SetMode(p, args[0], args[1])
+	case 1:
+		return p.Server.GetMode(p, args[0])
+	}
+	return &NeedsMoreParams{p.Nick, "MODE"}
+}
+
+func cmdTopic(p *Peer, args []string, message string) error {
+	switch {
+	case len(args) == 2:
+		// An empty topic clears it.
+		return p.Server.SetTopic(p, args[0], args[1])
+	case len(args) != 1:
+		return &NeedsMoreParams{p.Nick, "TOPIC"}
+	case message != "":
+		return p.Server.SetTopic(p, args[0], message)
+	}
+	return p.Server.SendTopic(p, args[0])
+}
+
+func cmdPing(p *Peer, args []string, message string) error {
+	p.Say("PONG %s", p.NickOrAsterix())
+	return nil
+}
+
+func cmdPong(p *Peer, args []string, message string) error {
+	return nil
+}
+
+func cmdLusers(p *Peer, args []string, message string) error {
+	p.SendUserList()
+	return nil
+}
+
+func cmdOper(p *Peer, args []string, message string) error {
+	if len(args) != 2 {
+		return &NeedsMoreParams{p.Nick, "OPER"}
+	}
+	if !p.Server.Oper(p, args[0], args[1]) {
+		return &IncorrectPassword{p.Nick}
+	}
+	p.Say("381 %s :You are now an IRC operator", p.Nick)
+	return nil
+}
+
+func cmdRehash(p *Peer, args []string, message string) error {
+	if !p.IsOperator() {
+		return &NoPrivileges{p.Nick}
+	}
+	if p.Server.ConfigPath != "" {
+		p.Say("382 %s %s :Rehashing", p.Nick, p.Server.ConfigPath)
+	}
+	if err := p.Server.Rehash(); err != nil {
+		return &RehashFailed{p.Nick, err}
+	}
+	return nil
+}
+
+func cmdTerminate(restart bool) CommandHandler {
+	return func(p *Peer, args []string, message string) error {
+		if !p.IsGlobalOperator {
+			return &NoPrivileges{p.Nick}
+		}
+		go p.Server.Terminate(restart)
+		return nil
+	}
+}
+
+func cmdChangeHost(p *Peer, args []string, message string) error {
+	if !p.IsOperator() {
+		return &NoPrivileges{p.Nick}
+	}
+	if len(args) != 3 {
+		return &NeedsMoreParams{p.Nick, "CHGHOST"}
+	}
+	return p.Server.ChangeHost(p, args[0], args[1], args[2])
+}
+
+func cmdLinks(p *Peer, args []string, message string) error {
+	p.Server.SendLinks(p)
+	return nil
+}
+
+func cmdMap(p *Peer, args []string, message string) error {
+	p.Server.SendMap(p)
+	return nil
+}
+
+func cmdConnect(p *Peer, args []string, message string) error {
+	if !p.IsGlobalOperator {
+		return &NoPrivileges{p.Nick}
+	}
+	if len(args) == 0 {
+		return &NeedsMoreParams{p.Nick, "CONNECT"}
+	}
+	// Dialling may take a while, and shouldn't hold up the operator's
+	// reader, which may be shared with other peers.
+	nick, target := p.Nick, args[0]
+	go func() {
+		if err := p.Server.Connect(target); err != nil {
+			p.Say("%s", &ConnectFailed{nick, target, err})
+		}
+	}()
+	return nil
+}
+
+func cmdSquit(p *Peer, args []string, message string) error {
+	if !p.IsGlobalOperator {
+		return &NoPrivileges{p.Nick}
+	}
+	if len(args) == 0 {
+		return &NeedsMoreParams{p.Nick, "SQUIT"}
+	}
+	return p.Server.Squit(p, args[0], message)
+}
+
+func cmdWallops(p *Peer, args []string, message string) error {
+	if !p.IsOperator() {
+		return &NoPrivileges{p.Nick}
+	}
+	if message == "" {
+		return &NeedsMoreParams{p.Nick, "WALLOPS"}
+	}
+	p.Server.Wallops(p, message)
+	return nil
+}
+
+func cmdWhois(p *Peer, args []string, message string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	return p.Server.Whois(p, args[0])
+}
+
+func cmdQuit(p *Peer, args []string, message string) error {
+	return p.Server.Quit(p, message)
+}
@@ -0,0 +1,150 @@
+package irc_go
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// Config is the on-disk server configuration, stored as JSON.
+type Config struct {
+	ServerName string            `json:"server_name"`
+	Listen     []string          `json:"listen"`
+	Motd       string            `json:"motd"`
+	Opers      map[string]string `json:"opers"`
+	LocalOpers map[string]string `json:"local_opers"`
+	Limits     Limits            `json:"limits"`
+	Bans       []string          `json:"bans"`
+
+	ChannelStore string `json:"channel_store"`
+	AccountStore string `json:"account_store"`
+	NickGrace    int    `json:"nick_grace_seconds"`
+	ChanServ     bool   `json:"chanserv"`
+
+	HistoryLimit int    `json:"history_limit"`
+	HistoryFile  string `json:"history_file"`
+
+	// Servers we may link with, by name.
+	Links map[string]LinkConfig `json:"links"`
+
+	// Addresses to serve WebSocket clients on, the reverse proxies trusted
+	// to report a client's real address, and whether those proxies send a
+	// PROXY protocol header when connecting to our listeners.
+	WebSocketListen []string `json:"websocket_listen"`
+	TrustedProxies  CIDRList `json:"trusted_proxies"`
+	ProxyProtocol   bool     `json:"proxy_protocol"`
+
+	// Addresses exempt from the per-address limits and throttle.
+	ConnectExempt CIDRList `json:"connect_exempt"`
+}
+
+// A set of address ranges, written in JSON as a list of CIDRs or plain
+// addresses.
+type CIDRList []*net.IPNet
+
+func (l *CIDRList) UnmarshalJSON(buf []byte) error {
+	entries := []string{}
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		return err
+	}
+	*l = nil
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return fmt.Errorf("irc: invalid address %q", entry)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 128
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return err
+		}
+		*l = append(*l, network)
+	}
+	return nil
+}
+
+func (l CIDRList) Contains(ip net.IP) bool {
+	for _, network := range l {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Limits are the tunable resource limits. A zero value means "unlimited".
+type Limits struct {
+	MaxClients  int `json:"max_clients"`
+	MaxChannels int `json:"max_channels"`
+	NickLen     int `json:"nick_len"`
+	// Topics are cut to this many bytes, or DefaultTopicLen if it's zero.
+	TopicLen int `json:"topic_len"`
+
+	// Connections allowed from one address, and from one network of the
+	// given prefix lengths (by default a /24 or a /64).
+	MaxPerIP   int `json:"max_per_ip"`
+	MaxPerCIDR int `json:"max_per_cidr"`
+	CIDRv4     int `json:"cidr_v4"`
+	CIDRv6     int `json:"cidr_v6"`
+
+	// An address connecting more than ThrottleConnections times within
+	// ThrottleSeconds is refused for ThrottleBanSeconds.
+	ThrottleConnections int `json:"throttle_connections"`
+	ThrottleSeconds     int `json:"throttle_seconds"`
+	ThrottleBanSeconds  int `json:"throttle_ban_seconds"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := json.Unmarshal(buf, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Installs the given configuration. The server name and listeners are only
+// read at startup, so changing them requires a restart.
+func (s *Server) ApplyConfig(c *Config) {
+	s.Lock()
+	defer s.Unlock()
+
+	if c.Motd != "" {
+		s.MessageOfTheDayPath = c.Motd
+	}
+	s.Opers = c.Opers
+	s.LocalOpers = c.LocalOpers
+	s.Limits = c.Limits
+	s.Bans = c.Bans
+	s.Links = c.Links
+	s.TrustedProxies = c.TrustedProxies
+	s.ProxyProtocol = c.ProxyProtocol
+	s.ConnectExempt = c.ConnectExempt
+}
+
+var ErrNoConfig = errors.New("no configuration file was loaded")
+
+// Re-reads the configuration file, leaving all connections intact.
+func (s *Server) Rehash() error {
+	if s.ConfigPath == "" {
+		return ErrNoConfig
+	}
+	c, err := LoadConfig(s.ConfigPath)
+	if err != nil {
+		return err
+	}
+	s.ApplyConfig(c)
+	return nil
+}
@@ -0,0 +1,75 @@
+package irc_go_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/fatlotus/fast-irc-golang"
+)
+
+func TestRehash(t *testing.T) {
+	fp, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fp.Name())
+
+	write := func(body string) {
+		if err := ioutil.WriteFile(fp.Name(), []byte(body), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := NewServer()
+	s.ConfigPath = fp.Name()
+
+	write(`{"opers": {"alice": "secret"}, "limits": {"nick_len": 9}}`)
+	if err := s.Rehash(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.CheckOperator("alice", "secret") {
+		t.Errorf("expected alice to be an operator")
+	}
+	if s.Limits.NickLen != 9 {
+		t.Errorf("expected nick_len 9, got %d", s.Limits.NickLen)
+	}
+
+	write(`{"opers": {"bob": "hunter2"}, "bans": ["*!*@10.*"]}`)
+	if err := s.Rehash(); err != nil {
+		t.Fatal(err)
+	}
+	if s.CheckOperator("alice", "secret") {
+		t.Errorf("expected alice to have been removed")
+	}
+	if !s.CheckOperator("bob", "hunter2") {
+		t.Errorf("expected bob to be an operator")
+	}
+
+	write(`{not json`)
+	if err := s.Rehash(); err == nil {
+		t.Errorf("expected a parse error")
+	}
+	if !s.CheckOperator("bob", "hunter2") {
+		t.Errorf("a failed rehash should keep the previous config")
+	}
+}
+
+func TestMatchMask(t *testing.T) {
+	cases := []struct {
+		mask, subject string
+		match         bool
+	}{
+		{"*!*@10.*", "nick!user@10.0.0.1", true},
+		{"*!*@10.*", "nick!user@192.168.0.1", false},
+		{"Nick!*@*", "nick!u@h", true},
+		{"n?ck!*", "nick!u@h", true},
+		{"n?ck!*", "nck!u@h", false},
+		{"*", "", true},
+	}
+	for _, c := range cases {
+		if MatchMask(c.mask, c.subject) != c.match {
+			t.Errorf("MatchMask(%q, %q) != %v", c.mask, c.subject, c.match)
+		}
+	}
+}
@@ -166,3 +166,127 @@ type IncorrectPassword struct {
 func (i IncorrectPassword) Error() string {
 	return fmt.Sprintf("464 %s :Password incorrect", i.Sender)
 }
+
+type ErroneousNickname struct {
+	Sender string
+	Nick   string
+}
+
+func (e ErroneousNickname) Error() string {
+	return fmt.Sprintf("432 %s %s :Erroneous nickname", e.Sender, e.Nick)
+}
+
+type TooManyChannels struct {
+	Sender  string
+	Channel string
+}
+
+func (t TooManyChannels) Error() string {
+	return fmt.Sprintf("405 %s %s :You have joined too many channels", t.Sender, t.Channel)
+}
+
+type NoPrivileges struct {
+	Sender string
+}
+
+func (n NoPrivileges) Error() string {
+	return fmt.Sprintf("481 %s :Permission Denied- You're not an IRC operator", n.Sender)
+}
+
+type RehashFailed struct {
+	Sender string
+	Err    error
+}
+
+func (r RehashFailed) Error() string {
+	return fmt.Sprintf("400 %s REHASH :Rehash failed: %s", r.Sender, r.Err)
+}
+
+type Banned struct{}
+
+func (b Banned) Error() string {
+	return "ERROR :Closing Link: (You are banned from this server)"
+}
+
+type BannedFromChannel struct {
+	Sender  string
+	Channel string
+}
+
+func (b BannedFromChannel) Error() string {
+	return fmt.Sprintf("474 %s %s :Cannot join channel (+b)", b.Sender, b.Channel)
+}
+
+type ChannelAlreadyRegistered struct {
+	Sender  string
+	Channel string
+}
+
+func (c ChannelAlreadyRegistered) Error() string {
+	return fmt.Sprintf("NOTICE %s :%s is already registered", c.Sender, c.Channel)
+}
+
+type NeedsIdentification struct {
+	Sender  string
+	Channel string
+}
+
+func (n NeedsIdentification) Error() string {
+	return fmt.Sprintf("477 %s %s :You must identify to NickServ before registering a channel", n.Sender, n.Channel)
+}
+
+type InvalidCapCommand struct {
+	Sender  string
+	Command string
+}
+
+func (i InvalidCapCommand) Error() string {
+	return fmt.Sprintf("410 %s %s :Invalid CAP command", i.Sender, i.Command)
+}
+
+// A standard reply, as used by IRCv3 extensions such as CHATHISTORY.
+type FailReply struct {
+	Command     string
+	Code        string
+	Context     string
+	Description string
+}
+
+func (f FailReply) Error() string {
+	return fmt.Sprintf("FAIL %s %s %s :%s", f.Command, f.Code, f.Context, f.Description)
+}
+
+type LinkRejected struct {
+	Reason string
+}
+
+func (l LinkRejected) Error() string {
+	return fmt.Sprintf("ERROR :Closing Link: (%s)", l.Reason)
+}
+
+type NoSuchServer struct {
+	Sender string
+	Server string
+}
+
+func (n NoSuchServer) Error() string {
+	return fmt.Sprintf("402 %s %s :No such server", n.Sender, n.Server)
+}
+
+type ConnectFailed struct {
+	Sender string
+	Server string
+	Err    error
+}
+
+func (c ConnectFailed) Error() string {
+	return fmt.Sprintf("NOTICE %s :Connect to %s failed: %s", c.Sender, c.Server, c.Err)
+}
+
+type ConnectionRefused struct {
+	Reason string
+}
+
+func (c ConnectionRefused) Error() string {
+	return fmt.Sprintf("ERROR :Closing Link: (%s)", c.Reason)
+}
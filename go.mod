@@ -1,7 +1,10 @@
 module github.com/fatlotus/fast-irc-golang
 
+go 1.27.1
+
 require (
 	github.com/andreyvit/diff v0.0.0-20170406064948-c7f18ee00883
-	github.com/fatlotus/batchwriter v0.0.0-20180902175937-b24bdb811de7
-	github.com/sergi/go-diff v1.0.0 // indirect
+	golang.org/x/crypto v0.11.0
 )
+
+require github.com/sergi/go-diff v1.0.0 // indirect
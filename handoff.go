@@ -0,0 +1,488 @@
+//go:build !windows
+// +build !windows
+
+package irc_go
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// How many descriptors to pack into each control message; the kernel caps
+// this at SCM_MAX_FD (253).
+const handoffBatch = 200
+
+// Everything a replacement process needs to resume serving. Descriptors are
+// sent separately: first the listeners, then one per peer with Fd >= 0.
+type handoffState struct {
+	UserCount   int
+	NextPeerKey int
+	Listeners   int
+	Peers       []handoffPeer
+	Rooms       []handoffRoom
+}
+
+type handoffPeer struct {
+	Key              int
+	Fd               int
+	Nick             string
+	User             string
+	FullName         string
+	Host             string
+	Addr             string
+	Away             string
+	Account          string
+	IsGlobalOperator bool
+	UserModes        UserModes
+	SentWelcome      bool
+	Caps             map[string]bool
+	CapNegotiating   bool
+	Pending          []byte
+}
+
+type handoffRoom struct {
+	Name         string
+	Members      []handoffMember
+	Created      time.Time
+	Topic        string
+	TopicSetter  string
+	TopicTime    time.Time
+	Bans         []string
+	IsModerated  bool
+	IsFixedTopic bool
+	IsSecret     bool
+	IsPrivate    bool
+	// Whether -n is set.
+	AllowsExternal bool
+}
+
+type handoffMember struct {
+	Key        int
+	Privileges Privileges
+	Joined     time.Time
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Passes every listener and client connection, along with the nicks, rooms
+// and modes, to a replacement process on the other end of conn. On success
+// this server no longer owns any connections and the caller should exit; on
+// failure it resumes serving as if nothing happened.
+//
+// Only connections with a descriptor of their own can be passed along. The
+// rest, such as WebSocket clients and peers added with Attach or Pipe, are
+// told the server is restarting and disconnected, as are linked servers.
+func (s *Server) HandOff(conn *net.UnixConn) error {
+	s.Lock()
+	if s.Handover != nil || s.Closing != "" {
+		s.Unlock()
+		return errors.New("irc: server is already shutting down")
+	}
+	h := &Handover{Done: make(chan bool)}
+	s.Handover = h
+	listeners := append([]net.Listener(nil), s.Listeners...)
+	s.Unlock()
+
+	// Pause the accept loops and every reader.
+	for _, ln := range listeners {
+		if d, ok := ln.(deadliner); ok {
+			d.SetDeadline(time.Now())
+		}
+	}
+	s.Lock()
+	for _, p := range s.Peers {
+		if p.Conn != nil {
+			p.Conn.SetReadDeadline(time.Now())
+		}
+	}
+	s.Unlock()
+	s.interruptPollers()
+	s.Handlers.Wait()
+
+	s.Lock()
+	state, files, err := s.snapshot(listeners)
+	s.Unlock()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		s.resumeAfterHandoff(h, false)
+		return err
+	}
+
+	// Server links can't be handed over, so the network splits instead;
+	// nor can peers that aren't on a socket of their own, such as WebSocket
+	// clients, so they're disconnected. The snapshot already leaves them
+	// out.
+	dropped := []*Peer{}
+	s.Lock()
+	for _, srv := range s.Servers {
+		if srv.Hops == 1 {
+			s.dropLink(srv.Via, "Server restarting")
+		}
+	}
+	for key, p := range s.Peers {
+		if handsOver(p) {
+			continue
+		}
+		if p.LinkName == "" {
+			p.Write("ERROR :Closing Link: (Server restarting)\r\n")
+			s.quit(p, "Server restarting")
+			if p.Nick != "" {
+				delete(s.Nicks, p.Nick)
+			}
+			if p.SentWelcome {
+				s.UserCount -= 1
+			}
+		}
+		delete(s.Peers, key)
+		s.countAddr(p.Addr, -1)
+		dropped = append(dropped, p)
+	}
+	s.Unlock()
+	for _, p := range dropped {
+		p.Output.Close()
+		s.closeConn(p)
+	}
+
+	// Make sure nothing we've queued arrives after the new process starts
+	// writing.
+	s.Lock()
+	for _, p := range s.Peers {
+		p.Output.Close()
+	}
+	s.Unlock()
+	if err := sendHandoff(conn, state, files); err != nil {
+		s.resumeAfterHandoff(h, true)
+		return err
+	}
+
+	s.Lock()
+	s.Closing = "Server restarting"
+	s.Listeners = nil
+	for _, p := range s.Peers {
+		if p.Conn != nil {
+			p.Conn.Close()
+		}
+	}
+	s.Unlock()
+	h.Succeeded = true
+	close(h.Done)
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	return nil
+}
+
+// Whether p can be passed to a new process: a local user on a socket of its
+// own, or one with no connection at all.
+func handsOver(p *Peer) bool {
+	if p.LinkName != "" || p.Neighbour != nil {
+		return false
+	}
+	_, ok := p.Conn.(filer)
+	return ok || p.Conn == nil
+}
+
+// Undoes the pause of a failed handoff, restarting every reader, and every
+// writer too once they've been closed.
+func (s *Server) resumeAfterHandoff(h *Handover, closedOutput bool) {
+	s.Lock()
+	for _, p := range s.Peers {
+		if p.Conn == nil {
+			continue
+		}
+		if closedOutput {
+			p.Output = NewSendQueue(p.Conn, SendQueueLen)
+		}
+		p.Conn.SetReadDeadline(time.Time{})
+		s.Handlers.Add(1)
+		s.readFrom(p)
+	}
+	s.Handover = nil
+	s.Unlock()
+	close(h.Done)
+}
+
+func (s *Server) snapshot(listeners []net.Listener) (*handoffState, []*os.File, error) {
+	files := []*os.File{}
+	dup := func(v interface{}) error {
+		f, ok := v.(filer)
+		if !ok {
+			return errors.New("irc: cannot hand off a non-file socket")
+		}
+		fp, err := f.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, fp)
+		return nil
+	}
+
+	state := &handoffState{
+		UserCount:   s.UserCount,
+		NextPeerKey: s.NextPeerKey,
+		Listeners:   len(listeners),
+	}
+	for _, ln := range listeners {
+		if err := dup(ln); err != nil {
+			return nil, files, err
+		}
+	}
+	handed := map[int]bool{}
+	for _, p := range s.Peers {
+		if !handsOver(p) {
+			if p.LinkName == "" && p.SentWelcome {
+				state.UserCount -= 1
+			}
+			continue
+		}
+		handed[p.Key] = true
+		fd := -1
+		if p.Conn != nil {
+			if err := dup(p.Conn); err != nil {
+				return nil, files, err
+			}
+			fd = len(files) - 1
+		}
+		p.CapsLock.RLock()
+		var caps map[string]bool
+		if p.Caps != nil {
+			caps = map[string]bool{}
+			for name, on := range p.Caps {
+				caps[name] = on
+			}
+		}
+		p.CapsLock.RUnlock()
+		state.Peers = append(state.Peers, handoffPeer{
+			Key:              p.Key,
+			Fd:               fd,
+			Nick:             p.Nick,
+			User:             p.User,
+			FullName:         p.FullName,
+			Host:             p.Host,
+			Addr:             p.Addr,
+			Away:             p.Away,
+			Account:          p.Account,
+			IsGlobalOperator: p.IsGlobalOperator,
+			UserModes:        p.UserModes,
+			SentWelcome:      p.SentWelcome,
+			Caps:             caps,
+			CapNegotiating:   p.CapNegotiating,
+			Pending:          p.Pending,
+		})
+	}
+	for name, room := range s.Rooms {
+		r := handoffRoom{
+			Name:         name,
+			Created:      room.Created,
+			Topic:        room.Topic,
+			TopicSetter:  room.TopicSetter,
+			TopicTime:    room.TopicTime,
+			Bans:         room.Bans,
+			IsModerated:  room.IsModerated,
+			IsFixedTopic: room.IsFixedTopic,
+			IsSecret:     room.IsSecret,
+			IsPrivate:    room.IsPrivate,
+
+			AllowsExternal: room.AllowsExternal,
+		}
+		for key, member := range room.Members {
+			if handed[key] {
+				r.Members = append(r.Members, handoffMember{key, member.Privileges, member.Joined})
+			}
+		}
+		if len(r.Members) > 0 {
+			state.Rooms = append(state.Rooms, r)
+		}
+	}
+	return state, files, nil
+}
+
+func sendHandoff(conn *net.UnixConn, state *handoffState, files []*os.File) error {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(buf)))
+	if _, err := conn.Write(append(header, buf...)); err != nil {
+		return err
+	}
+	if err := readAck(conn); err != nil {
+		return err
+	}
+
+	for len(files) > 0 {
+		n := len(files)
+		if n > handoffBatch {
+			n = handoffBatch
+		}
+		fds := make([]int, n)
+		for i, f := range files[:n] {
+			fds[i] = int(f.Fd())
+		}
+		if _, _, err := conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(fds...), nil); err != nil {
+			return err
+		}
+		files = files[n:]
+	}
+	return readAck(conn)
+}
+
+func readAck(conn *net.UnixConn) error {
+	ack := []byte{0}
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return err
+	}
+	if ack[0] != 'k' {
+		return errors.New("irc: handoff rejected by new process")
+	}
+	return nil
+}
+
+// Receives the state sent by HandOff from the previous process and resumes
+// serving its peers. The inherited listeners are returned so the caller can
+// pass each to ServeListener.
+func (s *Server) TakeOver(conn *net.UnixConn) ([]net.Listener, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	state := &handoffState{}
+	if err := json.Unmarshal(buf, state); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{'k'}); err != nil {
+		return nil, err
+	}
+
+	want := state.Listeners
+	for _, p := range state.Peers {
+		if p.Fd >= 0 {
+			want++
+		}
+	}
+	files := []*os.File{}
+	for len(files) < want {
+		oob := make([]byte, syscall.CmsgSpace(handoffBatch*4))
+		_, oobn, _, _, err := conn.ReadMsgUnix(make([]byte, 1), oob)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			fds, err := syscall.ParseUnixRights(&msg)
+			if err != nil {
+				return nil, err
+			}
+			for _, fd := range fds {
+				files = append(files, os.NewFile(uintptr(fd), "handoff"))
+			}
+		}
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	listeners := []net.Listener{}
+	for _, f := range files[:state.Listeners] {
+		ln, err := net.FileListener(f)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+
+	s.Lock()
+	s.UserCount = state.UserCount
+	s.NextPeerKey = state.NextPeerKey
+	for _, hp := range state.Peers {
+		p := &Peer{
+			Key:              hp.Key,
+			Server:           s,
+			Nick:             hp.Nick,
+			User:             hp.User,
+			FullName:         hp.FullName,
+			Host:             hp.Host,
+			Addr:             hp.Addr,
+			Away:             hp.Away,
+			Account:          hp.Account,
+			IsGlobalOperator: hp.IsGlobalOperator,
+			UserModes:        hp.UserModes,
+			SentWelcome:      hp.SentWelcome,
+			Caps:             hp.Caps,
+			CapNegotiating:   hp.CapNegotiating,
+			Pending:          hp.Pending,
+		}
+		if hp.Fd >= 0 {
+			c, err := net.FileConn(files[hp.Fd])
+			if err != nil {
+				s.Unlock()
+				return nil, err
+			}
+			p.Conn = c
+		}
+		p.Output = NewSendQueue(p.Conn, SendQueueLen)
+		s.Peers[p.Key] = p
+		s.countAddr(p.Addr, 1)
+		if p.Nick != "" {
+			s.Nicks[p.Nick] = p
+		}
+	}
+	for _, hr := range state.Rooms {
+		room := &Room{
+			Members:      map[int]*Member{},
+			Created:      hr.Created,
+			Topic:        hr.Topic,
+			TopicSetter:  hr.TopicSetter,
+			TopicTime:    hr.TopicTime,
+			Bans:         hr.Bans,
+			IsModerated:  hr.IsModerated,
+			IsFixedTopic: hr.IsFixedTopic,
+			IsSecret:     hr.IsSecret,
+			IsPrivate:    hr.IsPrivate,
+
+			AllowsExternal: hr.AllowsExternal,
+		}
+		for _, hm := range hr.Members {
+			room.Members[hm.Key] = &Member{
+				Peer:       s.Peers[hm.Key],
+				Privileges: hm.Privileges,
+				Joined:     hm.Joined,
+			}
+		}
+		s.Rooms[hr.Name] = room
+	}
+	for _, p := range s.Peers {
+		if p.Conn != nil {
+			s.Handlers.Add(1)
+			s.readFrom(p)
+		}
+	}
+	s.Unlock()
+
+	if _, err := conn.Write([]byte{'k'}); err != nil {
+		return nil, err
+	}
+	return listeners, nil
+}
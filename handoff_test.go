@@ -0,0 +1,203 @@
+//go:build !windows
+// +build !windows
+
+package irc_go_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	. "github.com/fatlotus/fast-irc-golang"
+)
+
+func socketPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := []*net.UnixConn{}
+	for _, fd := range fds {
+		f := os.NewFile(uintptr(fd), "pair")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c.(*net.UnixConn))
+	}
+	return conns[0], conns[1]
+}
+
+func readUntil(t *testing.T, c *Client, substr string) string {
+	for {
+		line, err := c.Reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("waiting for %q: %s", substr, err)
+		}
+		if strings.Contains(line, substr) {
+			return line
+		}
+	}
+}
+
+func TestHandOff(t *testing.T) {
+	old := NewServer()
+	if err := old.Listen("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	addr := old.Listener.Addr().String()
+	served := make(chan error, 1)
+	go func() {
+		served <- old.Serve()
+	}()
+
+	a, err := NewClient("a", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewClient("b", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	a.Join("#chan")
+	b.Join("#chan")
+	a.Writer.WriteString("CAP REQ :echo-message\r\n")
+	a.Writer.WriteString("TOPIC #chan :kept across restarts\r\n")
+	a.Writer.Flush()
+	readUntil(t, a, "ACK :echo-message")
+	readUntil(t, a, "TOPIC")
+	readUntil(t, b, "TOPIC")
+
+	// A pipe has no descriptor to pass along, so its peer is disconnected.
+	pipe, err := NewPipeClient("p", old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pipe.Close()
+	pipe.Join("#chan")
+	pipe.Writer.Flush()
+	readUntil(t, b, ":p!u@h JOIN #chan")
+	closed := make(chan string, 1)
+	go func() {
+		for {
+			line, err := pipe.Reader.ReadString('\n')
+			if err != nil || strings.HasPrefix(line, "ERROR") {
+				closed <- line
+				return
+			}
+		}
+	}()
+
+	// Send half of a line before the handoff, so that it has to be carried
+	// over to the new process.
+	a.Writer.WriteString("PRIVMSG #chan :hel")
+	a.Writer.Flush()
+
+	fresh := NewServer()
+	left, right := socketPair(t)
+	listeners := make(chan []net.Listener, 1)
+	go func() {
+		lns, err := fresh.TakeOver(right)
+		if err != nil {
+			t.Error(err)
+		}
+		listeners <- lns
+	}()
+	if err := old.HandOff(left); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("expected ErrServerClosed, got %v", err)
+	}
+	if line := <-closed; line != "ERROR :Closing Link: (Server restarting)\r\n" {
+		t.Errorf("expected the pipe peer to be disconnected, got %q", line)
+	}
+	readUntil(t, b, ":p!u@h QUIT :Server restarting")
+
+	lns := <-listeners
+	if len(lns) != 1 {
+		t.Fatalf("expected one listener, got %d", len(lns))
+	}
+	fresh.Listener = lns[0]
+	defer fresh.Listener.Close()
+	go fresh.Serve()
+
+	a.Writer.WriteString("lo\r\n")
+	a.Writer.Flush()
+	if line := readUntil(t, b, "PRIVMSG"); !strings.Contains(line, "PRIVMSG #chan :hello") {
+		t.Errorf("unexpected message %q", line)
+	}
+	// Capabilities are carried over too.
+	readUntil(t, a, "PRIVMSG #chan :hello")
+
+	// New connections reach the new server on the same port.
+	c, err := NewClient("c", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Join("#chan")
+	readUntil(t, c, "332 c #chan :kept across restarts")
+	if fresh.NumUsers() != 3 {
+		t.Errorf("expected 3 users, got %d", fresh.NumUsers())
+	}
+}
+
+// A listener that can't be passed to another process.
+type opaqueListener struct {
+	net.Listener
+}
+
+func TestHandOffFailure(t *testing.T) {
+	s := NewServer()
+	if err := s.Listen("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	addr := s.Listener.Addr().String()
+	go s.Serve()
+	opaque, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener(opaqueListener{opaque})
+	defer s.Stop(context.Background())
+
+	a, err := NewClient("a", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	// Connecting through the opaque listener ensures it's being served.
+	b, err := NewClient("b", opaque.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	a.Join("#chan")
+	a.Writer.Flush()
+	readUntil(t, a, "366 a #chan")
+	b.Join("#chan")
+	b.Writer.Flush()
+	readUntil(t, a, "b!u@h JOIN #chan")
+
+	left, _ := socketPair(t)
+	if err := s.HandOff(left); err == nil {
+		t.Fatal("expected the handoff to fail")
+	}
+
+	// Everyone carries on as before.
+	a.PrivMsg("#chan", "still here")
+	a.Writer.Flush()
+	if line := readUntil(t, b, "PRIVMSG"); !strings.Contains(line, "PRIVMSG #chan :still here") {
+		t.Errorf("unexpected message %q", line)
+	}
+	if s.NumUsers() != 2 {
+		t.Errorf("expected 2 users, got %d", s.NumUsers())
+	}
+}
@@ -0,0 +1,483 @@
+package irc_go
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The most messages a single CHATHISTORY request can return.
+const MaxChatHistory = 100
+
+type HistoryMessage struct {
+	ID      string
+	Time    time.Time
+	Source  string
+	Command string
+	Target  string
+	Text    string
+}
+
+// How many messages are kept for each conversation when no limit is given.
+const DefaultHistoryLimit = 1000
+
+// Keeps the most recent messages sent to each channel or between each pair
+// of accounts, optionally mirroring them to an append-only log so that they
+// can be replayed after a restart.
+type History struct {
+	Limit int
+	Log   io.Writer
+
+	targets map[string]*historyRing
+	sync.Mutex
+
+	// The log's path, if it can be compacted, how many messages are kept in
+	// memory, and how many lines the log holds.
+	path   string
+	kept   int
+	logged int
+}
+
+// A conversation's messages, oldest first from msgs[start], wrapping around
+// once the buffer is full so that adding one never copies the rest.
+type historyRing struct {
+	msgs  []HistoryMessage
+	start int
+}
+
+// Returns whether the ring grew rather than overwriting its oldest message.
+func (r *historyRing) add(m HistoryMessage, limit int) bool {
+	if limit <= 0 || len(r.msgs) < limit {
+		r.msgs = append(r.msgs, m)
+		return true
+	}
+	r.msgs[r.start] = m
+	r.start = (r.start + 1) % len(r.msgs)
+	return false
+}
+
+// Copies out the messages in chronological order.
+func (r *historyRing) messages() []HistoryMessage {
+	if r == nil {
+		return nil
+	}
+	msgs := make([]HistoryMessage, 0, len(r.msgs))
+	msgs = append(msgs, r.msgs[r.start:]...)
+	return append(msgs, r.msgs[:r.start]...)
+}
+
+// The i'th oldest message.
+func (r *historyRing) at(i int) *HistoryMessage {
+	return &r.msgs[(r.start+i)%len(r.msgs)]
+}
+
+type historyLogEntry struct {
+	Key string
+	HistoryMessage
+}
+
+// Keeps up to limit messages per conversation, or DefaultHistoryLimit if
+// limit isn't positive.
+func NewHistory(limit int) *History {
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	return &History{
+		Limit:   limit,
+		targets: map[string]*historyRing{},
+	}
+}
+
+// Replays the log at path (if it exists) and appends new messages to it. The
+// log is rewritten with only the messages still kept on opening, and again
+// whenever it has grown to twice that.
+func OpenHistoryFile(path string, limit int) (*History, error) {
+	h := NewHistory(limit)
+	h.path = path
+
+	if fp, err := os.Open(path); err == nil {
+		sc := bufio.NewScanner(fp)
+		for sc.Scan() {
+			entry := historyLogEntry{}
+			if err := json.Unmarshal(sc.Bytes(), &entry); err != nil {
+				fp.Close()
+				return nil, err
+			}
+			h.add(entry.Key, entry.HistoryMessage)
+		}
+		fp.Close()
+		if sc.Err() != nil {
+			return nil, sc.Err()
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := h.compact(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Rewrites the log with just the messages kept in memory, and reopens it for
+// appending. Must be called with h locked.
+func (h *History) compact() error {
+	tmp := h.path + ".tmp"
+	fp, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fp)
+	for key, ring := range h.targets {
+		for _, m := range ring.messages() {
+			buf, err := json.Marshal(historyLogEntry{key, m})
+			if err != nil {
+				fp.Close()
+				return err
+			}
+			w.Write(append(buf, '\n'))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, h.path); err != nil {
+		return err
+	}
+
+	fp, err = os.OpenFile(h.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if c, ok := h.Log.(io.Closer); ok {
+		c.Close()
+	}
+	h.Log = fp
+	h.logged = h.kept
+	return nil
+}
+
+// The key under which a conversation is stored: the channel name, or both
+// accounts for a private message.
+func historyKey(sender, target string) string {
+	if target[0] == '#' {
+		return target
+	}
+	if sender > target {
+		sender, target = target, sender
+	}
+	return sender + " " + target
+}
+
+func (h *History) Add(key string, m HistoryMessage) error {
+	h.Lock()
+	defer h.Unlock()
+
+	h.add(key, m)
+	if h.Log == nil {
+		return nil
+	}
+	buf, err := json.Marshal(historyLogEntry{key, m})
+	if err != nil {
+		return err
+	}
+	if _, err := h.Log.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+	h.logged++
+	if h.path != "" && h.logged > 2*h.kept {
+		return h.compact()
+	}
+	return nil
+}
+
+func (h *History) add(key string, m HistoryMessage) {
+	ring := h.targets[key]
+	if ring == nil {
+		ring = &historyRing{}
+		h.targets[key] = ring
+	}
+	if ring.add(m, h.Limit) {
+		h.kept++
+	}
+}
+
+// Locates a msgid= or timestamp= reference, returning lo and hi such that
+// msgs[:lo] come strictly before it and msgs[hi:] strictly after.
+func findReference(msgs []HistoryMessage, ref string) (int, int, bool) {
+	if strings.HasPrefix(ref, "msgid=") {
+		id := ref[len("msgid="):]
+		for i, m := range msgs {
+			if m.ID == id {
+				return i, i + 1, true
+			}
+		}
+		return 0, 0, false
+	}
+	if strings.HasPrefix(ref, "timestamp=") {
+		at, err := time.Parse(ServerTimeFormat, ref[len("timestamp="):])
+		if err != nil {
+			return 0, 0, false
+		}
+		lo := sort.Search(len(msgs), func(i int) bool {
+			return !msgs[i].Time.Before(at)
+		})
+		hi := sort.Search(len(msgs), func(i int) bool {
+			return msgs[i].Time.After(at)
+		})
+		return lo, hi, true
+	}
+	return 0, 0, false
+}
+
+func first(msgs []HistoryMessage, limit int) []HistoryMessage {
+	if len(msgs) > limit {
+		return msgs[:limit]
+	}
+	return msgs
+}
+
+func last(msgs []HistoryMessage, limit int) []HistoryMessage {
+	if len(msgs) > limit {
+		return msgs[len(msgs)-limit:]
+	}
+	return msgs
+}
+
+// Answers a CHATHISTORY selector over a single conversation, returning
+// messages in chronological order.
+func (h *History) Query(key, subcommand string, refs []string, limit int) ([]HistoryMessage, bool) {
+	h.Lock()
+	msgs := h.targets[key].messages()
+	h.Unlock()
+
+	switch subcommand {
+	case "LATEST":
+		if refs[0] == "*" {
+			return last(msgs, limit), true
+		}
+		_, hi, ok := findReference(msgs, refs[0])
+		return last(msgs[hi:], limit), ok
+	case "BEFORE":
+		lo, _, ok := findReference(msgs, refs[0])
+		return last(msgs[:lo], limit), ok
+	case "AFTER":
+		_, hi, ok := findReference(msgs, refs[0])
+		return first(msgs[hi:], limit), ok
+	case "AROUND":
+		lo, _, ok := findReference(msgs, refs[0])
+		start := lo - limit/2
+		if start < 0 {
+			start = 0
+		}
+		return first(msgs[start:], limit), ok
+	case "BETWEEN":
+		loA, hiA, okA := findReference(msgs, refs[0])
+		loB, hiB, okB := findReference(msgs, refs[1])
+		if !okA || !okB {
+			return nil, false
+		}
+		if hiA <= loB {
+			return first(msgs[hiA:loB], limit), true
+		} else if hiB <= loA {
+			return last(msgs[hiB:loA], limit), true
+		}
+		return nil, true
+	}
+	return nil, false
+}
+
+// Lists the conversations visible through keys that have messages between
+// the two times, along with the time of the latest such message.
+func (h *History) Targets(keys []string, from, to time.Time) map[string]time.Time {
+	if to.Before(from) {
+		from, to = to, from
+	}
+	h.Lock()
+	defer h.Unlock()
+
+	result := map[string]time.Time{}
+	for _, key := range keys {
+		ring := h.targets[key]
+		if ring == nil {
+			continue
+		}
+		for i := len(ring.msgs) - 1; i >= 0; i-- {
+			if m := ring.at(i); m.Time.After(from) && m.Time.Before(to) {
+				result[key] = m.Time
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Lists the keys of the private conversations account has taken part in.
+func (h *History) Conversations(account string) []string {
+	h.Lock()
+	defer h.Unlock()
+
+	keys := []string{}
+	for key := range h.targets {
+		accounts := strings.Split(key, " ")
+		if len(accounts) == 2 && (accounts[0] == account || accounts[1] == account) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Reassembles the parameters of a CHATHISTORY line, since HandleLine splits
+// at the first colon, which is usually the one inside a timestamp.
+func chatHistoryParams(args []string, message string) []string {
+	if message == "" {
+		return args
+	}
+	if n := len(args); n > 0 && strings.HasPrefix(args[n-1], "timestamp=") {
+		rest := strings.Fields(args[n-1] + ":" + message)
+		return append(append([]string(nil), args[:n-1]...), rest...)
+	}
+	return append(args, strings.Fields(message)...)
+}
+
+func (s *Server) ChatHistory(sender *Peer, args []string) error {
+	if len(args) < 3 {
+		return &NeedsMoreParams{sender.Nick, "CHATHISTORY"}
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.History == nil {
+		return &FailReply{"CHATHISTORY", "MESSAGE_ERROR", args[0], "History is not enabled on this server"}
+	}
+
+	subcommand := strings.ToUpper(args[0])
+	if subcommand == "TARGETS" {
+		return s.chatHistoryTargets(sender, args)
+	}
+
+	nrefs := 1
+	if subcommand == "BETWEEN" {
+		nrefs = 2
+	}
+	if len(args) != 3+nrefs {
+		return &FailReply{"CHATHISTORY", "INVALID_PARAMS", subcommand, "Wrong number of parameters"}
+	}
+	target := args[1]
+	limit, err := strconv.Atoi(args[2+nrefs])
+	if err != nil || limit < 1 {
+		return &FailReply{"CHATHISTORY", "INVALID_PARAMS", subcommand, "Invalid limit"}
+	}
+	if limit > MaxChatHistory {
+		limit = MaxChatHistory
+	}
+
+	key := target
+	if target[0] == '#' {
+		room, ok := s.Rooms[target]
+		if !ok || !room.ContainsMember(sender) {
+			return &FailReply{"CHATHISTORY", "INVALID_TARGET", subcommand + " " + target, "Messages could not be retrieved"}
+		}
+	} else {
+		if sender.Account == "" {
+			return &FailReply{"CHATHISTORY", "INVALID_TARGET", subcommand + " " + target, "You must identify to read private messages"}
+		}
+		// The target is an account, or the nick of someone using one.
+		account := target
+		if peer := s.Nicks[target]; peer != nil && peer.Account != "" {
+			account = peer.Account
+		}
+		key = historyKey(sender.Account, account)
+	}
+
+	msgs, ok := s.History.Query(key, subcommand, args[2:2+nrefs], limit)
+	if !ok {
+		return &FailReply{"CHATHISTORY", "INVALID_PARAMS", subcommand, "Invalid message reference"}
+	}
+
+	batch := s.NewBatchID()
+	if sender.HasCap("batch") {
+		sender.Say("BATCH +%s chathistory %s", batch, target)
+	}
+	for _, m := range msgs {
+		sender.SayTagged(sender.Tags(batch, m.ID, m.Time), m.Source,
+			"%s %s :%s", m.Command, m.Target, m.Text)
+	}
+	if sender.HasCap("batch") {
+		sender.Say("BATCH -%s", batch)
+	}
+	return nil
+}
+
+func (s *Server) chatHistoryTargets(sender *Peer, args []string) error {
+	if len(args) != 4 {
+		return &FailReply{"CHATHISTORY", "INVALID_PARAMS", "TARGETS", "Wrong number of parameters"}
+	}
+	times := []time.Time{}
+	for _, ref := range args[1:3] {
+		at, err := time.Parse(ServerTimeFormat, strings.TrimPrefix(ref, "timestamp="))
+		if err != nil || !strings.HasPrefix(ref, "timestamp=") {
+			return &FailReply{"CHATHISTORY", "INVALID_PARAMS", "TARGETS", "Invalid timestamp"}
+		}
+		times = append(times, at)
+	}
+	limit, err := strconv.Atoi(args[3])
+	if err != nil || limit < 1 {
+		return &FailReply{"CHATHISTORY", "INVALID_PARAMS", "TARGETS", "Invalid limit"}
+	}
+
+	// The sender can see the channels they're in and, once identified, their
+	// own private conversations.
+	keys := []string{}
+	for name, room := range s.Rooms {
+		if room.ContainsMember(sender) {
+			keys = append(keys, name)
+		}
+	}
+	if sender.Account != "" {
+		keys = append(keys, s.History.Conversations(sender.Account)...)
+	}
+
+	found := s.History.Targets(keys, times[0], times[1])
+	keys = keys[:0]
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return found[keys[i]].Before(found[keys[j]])
+	})
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	batch := s.NewBatchID()
+	if sender.HasCap("batch") {
+		sender.Say("BATCH +%s draft/chathistory-targets", batch)
+	}
+	for _, key := range keys {
+		target := key
+		if accounts := strings.Split(key, " "); len(accounts) == 2 {
+			target = accounts[0]
+			if target == sender.Account {
+				target = accounts[1]
+			}
+		}
+		sender.SayTagged(sender.Tags(batch, "", time.Time{}), s.Name,
+			"CHATHISTORY TARGETS %s %s", target, found[key].UTC().Format(ServerTimeFormat))
+	}
+	if sender.HasCap("batch") {
+		sender.Say("BATCH -%s", batch)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package irc_go_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/fatlotus/fast-irc-golang"
+)
+
+func TestChatHistory(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	path := tmpdir + "/history.log"
+
+	s := NewServer()
+	if s.History, err = OpenHistoryFile(path, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Listen("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Listener.Close()
+	go s.Serve()
+	addr := s.Listener.Addr().String()
+
+	a, err := NewClient("a", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	a.Join("#chan")
+	for i := 1; i <= 4; i++ {
+		a.PrivMsg("#chan", fmt.Sprintf("message %d", i))
+	}
+	a.PrivMsg("b", "not here")
+	a.Writer.Flush()
+	readUntil(t, a, "401 a b")
+
+	// A late joiner catches up, with only the last three messages kept.
+	b, err := NewClient("b", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fmt.Fprintf(b.Writer, "CAP REQ :batch message-tags server-time\r\n")
+	b.Join("#chan")
+	fmt.Fprintf(b.Writer, "CHATHISTORY LATEST #chan * 10\r\n")
+	b.Writer.Flush()
+	readUntil(t, b, "BATCH +")
+	line := readUntil(t, b, "PRIVMSG")
+	if !strings.Contains(line, "message 2") || !strings.Contains(line, "msgid=") ||
+		!strings.Contains(line, "time=") {
+		t.Errorf("unexpected first message: %q", line)
+	}
+	msgid := strings.SplitN(strings.SplitN(line, "msgid=", 2)[1], ";", 2)[0]
+	readUntil(t, b, "message 4")
+	readUntil(t, b, "BATCH -")
+
+	fmt.Fprintf(b.Writer, "CHATHISTORY AFTER #chan msgid=%s 1\r\n", msgid)
+	b.Writer.Flush()
+	if line := readUntil(t, b, "PRIVMSG"); !strings.Contains(line, "message 3") {
+		t.Errorf("expected message 3, got %q", line)
+	}
+
+	// Only members can read a channel's history.
+	c, err := NewClient("c", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c.Writer, "CHATHISTORY LATEST #chan * 10\r\n")
+	c.Writer.Flush()
+	readUntil(t, c, "FAIL CHATHISTORY INVALID_TARGET")
+
+	// The log is replayed on startup.
+	replayed, err := OpenHistoryFile(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, ok := replayed.Query("#chan", "LATEST", []string{"*"}, 10)
+	if !ok || len(msgs) != 3 || msgs[2].Text != "message 4" {
+		t.Errorf("unexpected replayed history: %v", msgs)
+	}
+
+	// Replaying drops what's no longer kept from the log.
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(buf), "\n"); n != 3 {
+		t.Errorf("expected the log to be compacted to 3 lines, got %d", n)
+	}
+}
+
+func TestPrivateHistory(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	s := NewServer()
+	s.History = NewHistory(10)
+	if err := s.EnableNickServ(&FileAccountStore{Path: tmpdir + "/accounts.json"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.Background())
+
+	clients := map[string]*Client{}
+	for _, nick := range []string{"a", "b", "c"} {
+		c, err := NewPipeClient(nick, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		clients[nick] = c
+	}
+	a, b, c := clients["a"], clients["b"], clients["c"]
+	for _, client := range []*Client{a, b} {
+		send(client, "PRIVMSG NickServ :REGISTER password")
+		readUntil(t, client, "900")
+	}
+
+	// Messages between unidentified users aren't kept.
+	send(c, "PRIVMSG a :unkept")
+	send(a, "PRIVMSG b :kept")
+	readUntil(t, b, "PRIVMSG b :kept")
+
+	send(b, "CHATHISTORY LATEST a * 10")
+	readUntilWithout(t, b, "PRIVMSG b :kept", "unkept")
+
+	// Someone without the account can't read it, whatever their nick.
+	send(c, "CHATHISTORY LATEST a * 10")
+	readUntil(t, c, "FAIL CHATHISTORY INVALID_TARGET")
+	send(c, "CHATHISTORY TARGETS timestamp=2000-01-01T00:00:00.000Z timestamp=2100-01-01T00:00:00.000Z 10")
+	send(c, "PING :x")
+	readUntilWithout(t, c, "PONG", "CHATHISTORY TARGETS")
+
+	send(a, "CHATHISTORY TARGETS timestamp=2000-01-01T00:00:00.000Z timestamp=2100-01-01T00:00:00.000Z 10")
+	readUntil(t, a, "CHATHISTORY TARGETS b ")
+}
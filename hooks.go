@@ -0,0 +1,141 @@
+package irc_go
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Plugins extend the server by implementing any of the hook interfaces
+// below, and are added with AddPlugin. Hooks run on the reader of the peer
+// concerned without the server lock held, so they may call back into the
+// server, but a slow hook holds up that peer (and, with UseEpoll, others).
+
+// Called once a connection is accepted, before anything is read from it. An
+// error turns the peer away with an ERROR line.
+type ConnectHook interface {
+	OnConnect(p *Peer) error
+}
+
+// Called once a local user has completed registration.
+type RegisterHook interface {
+	OnRegister(p *Peer)
+}
+
+// Called once a local user has joined a channel.
+type JoinHook interface {
+	OnJoin(p *Peer, channel string)
+}
+
+// Called for each PRIVMSG or NOTICE a local user sends, before it's
+// delivered. The hook may rewrite m.Text, or veto the message by returning
+// an error: ErrDropMessage discards it silently, and anything else is sent
+// to the sender as the reply, so should be one of the numerics in errors.go.
+type MessageHook interface {
+	OnMessage(m *Message) error
+}
+
+// Called once a registered local user has left the server.
+type QuitHook interface {
+	OnQuit(p *Peer, reason string)
+}
+
+// Implemented by plugins that add their own commands.
+type CommandProvider interface {
+	Commands() []*Command
+}
+
+var ErrDropMessage = errors.New("irc: message dropped")
+
+// A PRIVMSG or NOTICE on its way to Target, a channel or nickname.
+type Message struct {
+	Sender  *Peer
+	Command string
+	Target  string
+	Text    string
+}
+
+// Registers a plugin's hooks and commands. Must be called before the server
+// starts serving.
+func (s *Server) AddPlugin(plugin interface{}) {
+	s.plugins = append(s.plugins, plugin)
+	if cp, ok := plugin.(CommandProvider); ok {
+		for _, c := range cp.Commands() {
+			s.AddCommand(c)
+		}
+	}
+}
+
+// Runs the connect hooks for a newly accepted peer, turning it away if one
+// objects. Reports whether the peer may go on to be read.
+func (s *Server) connected(p *Peer) bool {
+	for _, plugin := range s.plugins {
+		if h, ok := plugin.(ConnectHook); ok {
+			if err := h.OnConnect(p); err != nil {
+				p.Write(fmt.Sprintf("ERROR :Closing Link: (%s)\r\n", err))
+				s.RemovePeer(p)
+				// The peer may not be reading yet, so don't wait on it.
+				go func() {
+					p.Output.Close()
+					s.closeConn(p)
+					s.Handlers.Done()
+				}()
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *Server) registered(p *Peer) {
+	for _, plugin := range s.plugins {
+		if h, ok := plugin.(RegisterHook); ok {
+			h.OnRegister(p)
+		}
+	}
+}
+
+func (s *Server) joined(p *Peer, channel string) {
+	for _, plugin := range s.plugins {
+		if h, ok := plugin.(JoinHook); ok {
+			h.OnJoin(p, channel)
+		}
+	}
+}
+
+func (s *Server) quitted(p *Peer, reason string) {
+	for _, plugin := range s.plugins {
+		if h, ok := plugin.(QuitHook); ok {
+			h.OnQuit(p, reason)
+		}
+	}
+}
+
+// Passes a message from a local user through the message hooks, then on to
+// a service or SendMessage.
+func (s *Server) deliver(sender *Peer, cmd, target, text string) error {
+	if len(s.plugins) > 0 {
+		m := &Message{Sender: sender, Command: cmd, Target: target, Text: text}
+		for _, plugin := range s.plugins {
+			if h, ok := plugin.(MessageHook); ok {
+				if err := h.OnMessage(m); err == ErrDropMessage {
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+		}
+		if m.Text == "" {
+			return nil
+		}
+		text = m.Text
+	}
+
+	if svc, ok := s.Services[strings.ToLower(target)]; ok {
+		if cmd == "PRIVMSG" {
+			svc.Handle(sender, text)
+		}
+		return nil
+	}
+	return s.SendMessage(cmd, sender, target, text)
+}
@@ -0,0 +1,156 @@
+package irc_go_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/fatlotus/fast-irc-golang"
+)
+
+type testPlugin struct {
+	sync.Mutex
+	events []string
+	full   bool
+}
+
+func (t *testPlugin) record(format string, args ...interface{}) {
+	t.Lock()
+	defer t.Unlock()
+	t.events = append(t.events, fmt.Sprintf(format, args...))
+}
+
+func (t *testPlugin) OnConnect(p *Peer) error {
+	t.Lock()
+	defer t.Unlock()
+	if t.full {
+		return errors.New("No more connections")
+	}
+	return nil
+}
+
+func (t *testPlugin) OnRegister(p *Peer) {
+	t.record("register %s", p.Nick)
+}
+
+func (t *testPlugin) OnJoin(p *Peer, channel string) {
+	t.record("join %s %s", p.Nick, channel)
+	p.SayFrom("bot", "NOTICE %s :Welcome to %s", p.Nick, channel)
+}
+
+func (t *testPlugin) OnMessage(m *Message) error {
+	switch {
+	case strings.Contains(m.Text, "spam"):
+		return &CannotSendToChannel{m.Sender.Nick, m.Target}
+	case strings.Contains(m.Text, "quiet"):
+		return ErrDropMessage
+	}
+	m.Text = strings.Replace(m.Text, "darn", "d**n", -1)
+	return nil
+}
+
+func (t *testPlugin) OnQuit(p *Peer, reason string) {
+	t.record("quit %s %s", p.Nick, reason)
+}
+
+func (t *testPlugin) Commands() []*Command {
+	return []*Command{{
+		Name:       "HELLO",
+		MinParams:  1,
+		Registered: true,
+		Handler: func(p *Peer, args []string, message string) error {
+			p.Say("NOTICE %s :Hello, %s", p.Nick, args[0])
+			return nil
+		},
+	}}
+}
+
+func TestPlugins(t *testing.T) {
+	s := NewServer()
+	plugin := &testPlugin{}
+	s.AddPlugin(plugin)
+
+	a, err := NewPipeClient("a", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewPipeClient("b", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	a.Join("#chan")
+	readUntil(t, a, "NOTICE a :Welcome to #chan")
+	b.Join("#chan")
+	readUntil(t, b, "NOTICE b :Welcome to #chan")
+
+	send := func(c *Client, line string) {
+		c.Writer.WriteString(line + "\r\n")
+		c.Writer.Flush()
+	}
+	// Joining a channel again is not another join.
+	send(a, "JOIN #chan")
+	send(a, "HELLO")
+	readUntil(t, a, "461 a HELLO :Not enough parameters")
+	send(a, "HELLO world")
+	readUntil(t, a, "NOTICE a :Hello, world")
+
+	send(a, "PRIVMSG #chan :buy spam")
+	readUntil(t, a, "404 a #chan")
+	send(a, "PRIVMSG #chan :be quiet")
+	send(a, "PRIVMSG #chan :oh darn")
+	if line := readUntil(t, b, "PRIVMSG"); !strings.Contains(line, ":oh d**n") {
+		t.Errorf("expected the message to be rewritten, got %q", line)
+	}
+
+	send(b, "QUIT :bye")
+	readUntil(t, b, "ERROR")
+	readUntil(t, a, "QUIT :bye")
+
+	plugin.Lock()
+	plugin.full = true
+	plugin.Unlock()
+	if _, err := s.Pipe(); err != ErrConnectionRefused {
+		t.Errorf("expected ErrConnectionRefused, got %v", err)
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Stop(context.Background())
+	}()
+	readUntil(t, a, "ERROR")
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+	plugin.Lock()
+	defer plugin.Unlock()
+	sort.Strings(plugin.events)
+	expected := []string{
+		"join a #chan", "join b #chan", "quit a Server shutting down",
+		"quit b bye", "register a", "register b",
+	}
+	if strings.Join(plugin.events, ",") != strings.Join(expected, ",") {
+		t.Errorf("unexpected events %q", plugin.events)
+	}
+}
+
+func TestConnectHookRefuses(t *testing.T) {
+	s := NewServer()
+	s.AddPlugin(&testPlugin{full: true})
+	if err := s.Listen("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Listener.Close()
+
+	_, line := firstLine(t, s.Listener.Addr().String(), "a")
+	if line != "ERROR :Closing Link: (No more connections)\r\n" {
+		t.Errorf("expected the connection to be refused, got %q", line)
+	}
+}
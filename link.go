@@ -0,0 +1,716 @@
+package irc_go
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Describes this server to the rest of the network, in LINKS.
+const ServerInfo = "fast-irc-golang"
+
+// The longest list of members sent in a single NJOIN.
+const maxNJoinLength = 400
+
+// How long Connect waits for the other server to answer.
+const linkDialTimeout = 10 * time.Second
+
+// A neighbouring server this one may link with. Both ends list each other
+// under the same password; only the end that connects needs the Address.
+type LinkConfig struct {
+	Address  string `json:"address"`
+	Password string `json:"password"`
+}
+
+// Another server on the network.
+type RemoteServer struct {
+	Name string
+	Info string
+	// How many links away it is; neighbours are one hop away.
+	Hops int
+	// The server it is linked behind, which for neighbours is this one.
+	Uplink string
+	// The connection to the neighbour through which it is reached.
+	Via *Peer
+}
+
+// The link that p's messages arrive over: its own connection for a
+// neighbouring server, that of its server for a remote user, and nil for
+// anyone connected here.
+func (p *Peer) route() *Peer {
+	switch {
+	case p == nil:
+		return nil
+	case p.Neighbour != nil:
+		return p
+	case p.Origin != nil:
+		return p.Origin.Via
+	}
+	return nil
+}
+
+// Passes a line on to every neighbour, except the one that origin's messages
+// arrive over. Must be called with the server locked.
+func (s *Server) propagate(origin *Peer, source, format string, args ...interface{}) {
+	except := origin.route()
+	var line []byte
+	for _, srv := range s.Servers {
+		if srv.Hops != 1 || srv.Via == except {
+			continue
+		}
+		if line == nil {
+			line = []byte(":" + source + " " + fmt.Sprintf(format, args...) + "\r\n")
+		}
+		srv.Via.WriteBytes(line)
+	}
+}
+
+// Dials the named server from the configuration and links with it.
+func (s *Server) Connect(name string) error {
+	s.RLock()
+	config, ok := s.Links[name]
+	_, linked := s.Servers[name]
+	s.RUnlock()
+
+	if !ok || config.Address == "" {
+		return fmt.Errorf("no address is configured for %s", name)
+	}
+	if linked {
+		return fmt.Errorf("already linked with %s", name)
+	}
+	conn, err := net.DialTimeout("tcp", config.Address, linkDialTimeout)
+	if err != nil {
+		return err
+	}
+	return s.Link(conn, name)
+}
+
+// Links with the named server over conn, which need not be a network
+// connection: one end of a net.Pipe will do.
+func (s *Server) Link(conn net.Conn, name string) error {
+	s.RLock()
+	config, ok := s.Links[name]
+	s.RUnlock()
+	if !ok {
+		conn.Close()
+		return fmt.Errorf("no link is configured for %s", name)
+	}
+
+	p := s.AddPeer(conn)
+	p.LinkName = name
+	p.Write(fmt.Sprintf("PASS %s\r\nSERVER %s 1 :%s\r\n", config.Password, s.Name, ServerInfo))
+	s.readFrom(p)
+	return nil
+}
+
+// Completes the handshake with a neighbour that has sent PASS and SERVER,
+// introducing ourselves if it connected to us, and then everything we know.
+func (s *Server) AcceptLink(p *Peer, name, info string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	config, ok := s.Links[name]
+	if !ok || config.Password != p.Password {
+		return &LinkRejected{"Bad password"}
+	}
+	if p.LinkName != "" && p.LinkName != name {
+		return &LinkRejected{"Expected " + p.LinkName}
+	}
+	if _, exists := s.Servers[name]; exists || name == s.Name {
+		return &LinkRejected{"Server " + name + " already exists"}
+	}
+
+	if p.LinkName == "" {
+		p.Write(fmt.Sprintf("PASS %s\r\nSERVER %s 1 :%s\r\n", config.Password, s.Name, ServerInfo))
+	}
+	srv := &RemoteServer{Name: name, Info: info, Hops: 1, Uplink: s.Name, Via: p}
+	p.LinkName = name
+	p.Neighbour = srv
+	s.Servers[name] = srv
+
+	s.burst(p)
+	s.propagate(p, s.Name, "SERVER %s 2 :%s", name, info)
+	return nil
+}
+
+// Sends a new neighbour every server, user and channel on our side of the
+// network. Must be called with the server locked.
+func (s *Server) burst(link *Peer) {
+	servers := []*RemoteServer{}
+	for _, srv := range s.Servers {
+		if srv.Via != link {
+			servers = append(servers, srv)
+		}
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Hops < servers[j].Hops
+	})
+	for _, srv := range servers {
+		link.SayFrom(srv.Uplink, "SERVER %s %d :%s", srv.Name, srv.Hops+1, srv.Info)
+	}
+
+	for _, p := range s.Nicks {
+		if p.Key >= 0 && p.SentWelcome {
+			s.introduce(link, p)
+		}
+	}
+
+	for name, room := range s.Rooms {
+		members := ""
+		for _, member := range room.Members {
+			entry := ModePrefixes(room.Modes(member.Peer), true) + member.Nick
+			if len(members)+len(entry) >= maxNJoinLength {
+				link.SayFrom(s.Name, "NJOIN %s :%s", name, members[1:])
+				members = ""
+			}
+			members += "," + entry
+		}
+		if members == "" {
+			continue
+		}
+		link.SayFrom(s.Name, "NJOIN %s :%s", name, members[1:])
+
+		if room.IsModerated {
+			link.SayFrom(s.Name, "MODE %s +m", name)
+		}
+		if room.IsFixedTopic {
+			link.SayFrom(s.Name, "MODE %s +t", name)
+		}
+		if room.IsSecret {
+			link.SayFrom(s.Name, "MODE %s +s", name)
+		}
+		if room.IsPrivate {
+			link.SayFrom(s.Name, "MODE %s +p", name)
+		}
+		if room.AllowsExternal {
+			link.SayFrom(s.Name, "MODE %s -n", name)
+		}
+		for _, ban := range room.Bans {
+			link.SayFrom(s.Name, "MODE %s +b %s", name, ban)
+		}
+		if room.Topic != "" && room.TopicSetter != "" {
+			link.SayFrom(s.Name, "TOPIC %s %s %d :%s", name, room.TopicSetter,
+				room.TopicTime.Unix(), room.Topic)
+		} else if room.Topic != "" {
+			link.SayFrom(s.Name, "TOPIC %s :%s", name, room.Topic)
+		}
+	}
+}
+
+// Tells link about the user p, or every other neighbour if link is nil. Must
+// be called with the server locked.
+func (s *Server) introduce(link *Peer, p *Peer) {
+	server, hops := s.Name, 1
+	if p.Origin != nil {
+		server, hops = p.Origin.Name, p.Origin.Hops+1
+	}
+	umode := "+"
+	if p.IsGlobalOperator {
+		umode += "o"
+	}
+	for _, m := range userModeLetters {
+		if m.mode != ModeLocalOperator && p.UserModes&m.mode != 0 {
+			umode += string(m.letter)
+		}
+	}
+
+	const format = "NICK %s %d %s %s %s %s :%s"
+	if link != nil {
+		link.SayFrom(server, format, p.Nick, hops, p.User, p.Host, server, umode, p.FullName)
+	} else {
+		s.propagate(p, server, format, p.Nick, hops, p.User, p.Host, server, umode, p.FullName)
+	}
+}
+
+// Splits a server-to-server line into its source, command and parameters,
+// with any trailing parameter last.
+func parseServerLine(line string) (source, cmd string, params []string) {
+	if strings.HasPrefix(line, ":") {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return line[1:], "", nil
+		}
+		source, line = line[1:i], line[i+1:]
+	}
+
+	trailing, hasTrailing := "", false
+	if strings.HasPrefix(line, ":") {
+		line, trailing, hasTrailing = "", line[1:], true
+	} else if i := strings.Index(line, " :"); i >= 0 {
+		line, trailing, hasTrailing = line[:i], line[i+2:], true
+	}
+	params = strings.Fields(line)
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+	if len(params) == 0 {
+		return source, "", nil
+	}
+	return source, strings.ToUpper(params[0]), params[1:]
+}
+
+// Handles a line from a neighbouring server.
+func (s *Server) HandleServerLine(link *Peer, line string) {
+	source, cmd, params := parseServerLine(line)
+	if len(params) > 0 && params[0] == "" {
+		return
+	}
+
+	switch cmd {
+	case "PING":
+		link.SayFrom(s.Name, "PONG %s", s.Name)
+	case "ERROR":
+		s.Lock()
+		s.dropLink(link, "Remote error")
+		s.Unlock()
+	case "SERVER":
+		if len(params) == 3 {
+			s.addServer(link, source, params)
+		}
+	case "SQUIT":
+		if len(params) == 2 {
+			s.remoteSquit(link, source, params[0], params[1])
+		}
+	case "NICK":
+		if len(params) == 7 {
+			s.addRemoteUser(link, params)
+		} else if len(params) == 1 {
+			s.renameRemoteUser(link, source, params[0])
+		}
+	case "NJOIN":
+		if len(params) == 2 {
+			s.remoteJoin(link, params[0], params[1])
+		}
+	case "KILL":
+		if len(params) == 2 {
+			s.remoteKill(link, source, params[0], params[1])
+		}
+	case "QUIT":
+		s.Lock()
+		if p := s.Nicks[source]; p != nil && p.route() == link {
+			message := ""
+			if len(params) > 0 {
+				message = params[0]
+			}
+			s.quit(p, message)
+			delete(s.Nicks, p.Nick)
+		}
+		s.Unlock()
+	case "MODE", "TOPIC":
+		if len(params) >= 2 && params[0][0] == '#' && s.isRemoteServer(link, source) {
+			s.serverChannelChange(link, source, cmd, params)
+			return
+		}
+		fallthrough
+	default:
+		if p := s.remoteUser(link, source); p != nil {
+			s.remoteUserCommand(p, cmd, params)
+		}
+	}
+}
+
+// Carries out a command from a user on another server with the same code
+// that handles local users, which passes it on to the other neighbours.
+func (s *Server) remoteUserCommand(p *Peer, cmd string, params []string) {
+	switch cmd {
+	case "PRIVMSG", "NOTICE":
+		if len(params) == 2 {
+			s.SendMessage(cmd, p, params[0], params[1])
+		}
+	case "PART":
+		if len(params) == 1 {
+			s.Part(p, params[0], "")
+		} else if len(params) == 2 {
+			s.Part(p, params[0], params[1])
+		}
+	case "TOPIC":
+		if len(params) == 2 {
+			s.SetTopic(p, params[0], params[1])
+		}
+	case "MODE":
+		if len(params) == 3 {
+			s.SetMembershipMode(p, params[0], params[1], params[2])
+		} else if len(params) == 2 && params[0][0] == '#' {
+			s.SetMode(p, params[0], params[1])
+		} else if len(params) == 2 && params[0] == p.Nick {
+			s.Lock()
+			if applied, _ := p.applyUserModes(params[1], true); applied != "" {
+				s.propagate(p, p.Nick, "MODE %s :%s", p.Nick, applied)
+			}
+			s.Unlock()
+		}
+	case "AWAY":
+		if len(params) == 1 {
+			s.SetAway(p, params[0])
+		} else {
+			s.SetAway(p, "")
+		}
+	case "WALLOPS":
+		if len(params) == 1 {
+			s.Wallops(p, params[0])
+		}
+	}
+}
+
+// Looks up a user on the far side of link, ignoring anyone who isn't, such
+// as the loser of a nick collision whose messages were already in flight.
+func (s *Server) remoteUser(link *Peer, nick string) *Peer {
+	s.RLock()
+	defer s.RUnlock()
+
+	p := s.Nicks[nick]
+	if p == nil || p.route() != link {
+		return nil
+	}
+	return p
+}
+
+func (s *Server) isRemoteServer(link *Peer, name string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	srv, ok := s.Servers[name]
+	return ok && srv.Via == link
+}
+
+func (s *Server) addServer(link *Peer, uplink string, params []string) {
+	s.Lock()
+	defer s.Unlock()
+
+	name, info := params[0], params[2]
+	hops, err := strconv.Atoi(params[1])
+	if err != nil {
+		return
+	}
+	if _, exists := s.Servers[name]; exists || name == s.Name {
+		// The network would have a loop in it.
+		s.dropLink(link, "Server "+name+" already exists")
+		return
+	}
+	if uplink == "" {
+		uplink = link.Neighbour.Name
+	}
+	s.Servers[name] = &RemoteServer{Name: name, Info: info, Hops: hops, Uplink: uplink, Via: link}
+	s.propagate(link, uplink, "SERVER %s %d :%s", name, hops+1, info)
+}
+
+func (s *Server) remoteSquit(link *Peer, source, name, reason string) {
+	s.Lock()
+	defer s.Unlock()
+
+	srv, ok := s.Servers[name]
+	switch {
+	case name == s.Name:
+		s.dropLink(link, reason)
+	case !ok:
+	case srv.Via == link:
+		s.split(srv, reason)
+	case srv.Hops == 1:
+		// An operator elsewhere asked for our link to be closed.
+		s.dropLink(srv.Via, reason)
+	default:
+		srv.Via.SayFrom(source, "SQUIT %s :%s", name, reason)
+	}
+}
+
+// Closes the link to a server, either ours or one elsewhere on the network,
+// on behalf of an operator.
+func (s *Server) Squit(sender *Peer, name, reason string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	srv, ok := s.Servers[name]
+	if !ok {
+		return &NoSuchServer{sender.Nick, name}
+	}
+	if reason == "" {
+		reason = sender.Nick
+	}
+	if srv.Hops == 1 {
+		s.dropLink(srv.Via, reason)
+	} else {
+		srv.Via.SayFrom(sender.Nick, "SQUIT %s :%s", name, reason)
+	}
+	return nil
+}
+
+// Closes a link, splitting off every server behind it. The link's reader
+// then hangs up as though the connection had dropped. Must be called with the
+// server locked.
+func (s *Server) dropLink(link *Peer, reason string) {
+	if link.Neighbour == nil {
+		return
+	}
+	link.Write("ERROR :Closing Link: (" + reason + ")\r\n")
+	s.split(link.Neighbour, reason)
+	link.Neighbour = nil
+	s.interruptReader(link)
+}
+
+// Forgets srv and everything behind it, quitting their users from local
+// channels and telling the other neighbours. Must be called with the server
+// locked.
+func (s *Server) split(srv *RemoteServer, reason string) {
+	s.propagate(srv.Via, s.Name, "SQUIT %s :%s", srv.Name, reason)
+
+	gone := map[string]bool{srv.Name: true}
+	for changed := true; changed; {
+		changed = false
+		for name, other := range s.Servers {
+			if !gone[name] && gone[other.Uplink] {
+				gone[name] = true
+				changed = true
+			}
+		}
+	}
+
+	for nick, p := range s.Nicks {
+		if p.Origin != nil && gone[p.Origin.Name] {
+			// Our neighbours hear about the split, not each user.
+			delete(s.Nicks, nick)
+			s.quit(p, p.Origin.Uplink+" "+p.Origin.Name)
+		}
+	}
+	for name := range gone {
+		delete(s.Servers, name)
+	}
+}
+
+func (s *Server) addRemoteUser(link *Peer, params []string) {
+	s.Lock()
+	defer s.Unlock()
+
+	nick, user, host, server, umode, fullname := params[0], params[2], params[3], params[4], params[5], params[6]
+	hops, err := strconv.Atoi(params[1])
+	origin, ok := s.Servers[server]
+	if err != nil || !ok || origin.Via != link {
+		return
+	}
+	if existing := s.Nicks[nick]; existing != nil {
+		s.collide(existing, nick)
+		return
+	}
+
+	p := &Peer{
+		Key:         s.NextPeerKey,
+		Server:      s,
+		Nick:        nick,
+		User:        user,
+		Host:        host,
+		FullName:    fullname,
+		SentWelcome: true,
+		Origin:      origin,
+	}
+	p.applyUserModes(umode, true)
+	s.NextPeerKey += 1
+	s.Nicks[nick] = p
+	s.propagate(p, server, "NICK %s %d %s %s %s %s :%s", nick, hops+1, user, host, server, umode, fullname)
+}
+
+func (s *Server) renameRemoteUser(link *Peer, old, nick string) {
+	s.Lock()
+	defer s.Unlock()
+
+	p := s.Nicks[old]
+	if p == nil || p.route() != link {
+		return
+	}
+	if existing := s.Nicks[nick]; existing != nil && existing != p {
+		// The rest of the network never saw the change, and knows p by its
+		// old nick.
+		s.collide(existing, nick)
+		s.propagate(p, s.Name, "KILL %s :Nick collision", old)
+		s.kill(p, "Nick collision")
+		return
+	}
+	s.setNick(p, nick)
+}
+
+// Resolves two users claiming the same nick by removing both, as RFC 2813
+// does: every server drops whichever one it knows. Must be called with the
+// server locked.
+func (s *Server) collide(existing *Peer, nick string) {
+	s.propagate(nil, s.Name, "KILL %s :Nick collision", nick)
+	if existing.Key >= 0 {
+		s.kill(existing, "Nick collision")
+	}
+}
+
+func (s *Server) remoteKill(link *Peer, source, nick, reason string) {
+	s.Lock()
+	defer s.Unlock()
+
+	p := s.Nicks[nick]
+	if p == nil || p.Key < 0 {
+		return
+	}
+	s.propagate(link, source, "KILL %s :%s", nick, reason)
+	s.kill(p, reason)
+}
+
+// Removes a user from the network as seen from here, disconnecting them if
+// they're connected to us. Must be called with the server locked.
+func (s *Server) kill(p *Peer, reason string) {
+	delete(s.Nicks, p.Nick)
+	s.quit(p, "Killed ("+reason+")")
+	if p.Origin == nil {
+		p.SayFrom(s.Name, "KILL %s :%s", p.Nick, reason)
+		p.Write("ERROR :Closing Link: (Killed (" + reason + "))\r\n")
+		p.Nick = ""
+		s.interruptReader(p)
+	}
+}
+
+func (s *Server) remoteJoin(link *Peer, name, members string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if name[0] != '#' {
+		return
+	}
+	room, exists := s.Rooms[name]
+	joined := []string{}
+	for _, entry := range strings.Split(members, ",") {
+		nick := strings.TrimLeft(entry, PrefixSymbols)
+		p := s.Nicks[nick]
+		if p == nil || p.route() != link {
+			continue
+		}
+		privileges := Privileges(0)
+		for _, symbol := range entry[:len(entry)-len(nick)] {
+			privileges |= PrivilegeFor(PrefixModes[strings.IndexRune(PrefixSymbols, symbol)])
+		}
+
+		if !exists {
+			if record, ok := s.Registered[name]; ok {
+				room = record.NewRoom()
+			} else {
+				room = &Room{Members: map[int]*Member{}, Created: time.Now()}
+			}
+			s.Rooms[name] = room
+			exists = true
+		}
+		if member, ok := room.Members[p.Key]; ok && member.Peer == p {
+			member.Privileges |= privileges
+		} else {
+			room.AddMember(p, privileges)
+			s.announceJoin(p, name, room)
+		}
+		joined = append(joined, entry)
+	}
+	if len(joined) > 0 {
+		s.propagate(link, s.Name, "NJOIN %s :%s", name, strings.Join(joined, ","))
+	}
+}
+
+// Applies a channel mode or topic sent by a server, as part of a burst. A
+// burst topic may carry who set it and when, as in
+// "TOPIC #chan nick!user@host 1700000000 :topic".
+func (s *Server) serverChannelChange(link *Peer, source, cmd string, params []string) {
+	s.Lock()
+	defer s.Unlock()
+
+	name := params[0]
+	room, ok := s.Rooms[name]
+	if !ok {
+		return
+	}
+	relayed := "MODE " + strings.Join(params, " ")
+	if cmd == "TOPIC" {
+		room.Topic = params[len(params)-1]
+		room.TopicSetter = source
+		room.TopicTime = time.Now()
+		if len(params) == 4 {
+			if when, err := strconv.ParseInt(params[2], 10, 64); err == nil {
+				room.TopicSetter = params[1]
+				room.TopicTime = time.Unix(when, 0)
+			}
+		}
+		relayed = "TOPIC " + name + " " + room.TopicSetter + " " +
+			strconv.FormatInt(room.TopicTime.Unix(), 10) + " :" + room.Topic
+	} else if params[1] != "" {
+		enable := params[1][0] == '+'
+		for _, mode := range params[1][1:] {
+			switch mode {
+			case 'm':
+				room.IsModerated = enable
+			case 't':
+				room.IsFixedTopic = enable
+			case 's':
+				room.IsSecret = enable
+			case 'p':
+				room.IsPrivate = enable
+			case 'n':
+				room.AllowsExternal = !enable
+			case 'b':
+				if len(params) > 2 {
+					room.SetBan(params[2], enable)
+				}
+			}
+		}
+	}
+
+	text := relayed
+	if cmd == "TOPIC" {
+		text = "TOPIC " + name + " :" + room.Topic
+	}
+	line := NewRelay().Line(source, "%s", text)
+	defer line.Release()
+	for _, member := range room.Members {
+		line.SendTo(member.Peer)
+	}
+	s.propagate(link, source, "%s", relayed)
+}
+
+// Lists every server on the network, for LINKS.
+func (s *Server) SendLinks(sender *Peer) {
+	s.RLock()
+	defer s.RUnlock()
+
+	sender.Say("364 %s %s %s :0 %s", sender.Nick, s.Name, s.Name, ServerInfo)
+	names := []string{}
+	for name := range s.Servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		srv := s.Servers[name]
+		sender.Say("364 %s %s %s :%d %s", sender.Nick, srv.Name, srv.Uplink, srv.Hops, srv.Info)
+	}
+	sender.Say("365 %s * :End of LINKS list", sender.Nick)
+}
+
+// Draws the network as a tree, with the number of users on each server.
+func (s *Server) SendMap(sender *Peer) {
+	s.RLock()
+	defer s.RUnlock()
+
+	users := map[string]int{s.Name: s.UserCount}
+	for _, p := range s.Nicks {
+		if p.Origin != nil {
+			users[p.Origin.Name]++
+		}
+	}
+	children := map[string][]string{}
+	for name, srv := range s.Servers {
+		children[srv.Uplink] = append(children[srv.Uplink], name)
+	}
+
+	var walk func(name string, depth int)
+	walk = func(name string, depth int) {
+		indent := ""
+		if depth > 0 {
+			indent = strings.Repeat("  ", depth-1) + "`-"
+		}
+		sender.Say("006 %s :%s%s [%d]", sender.Nick, indent, name, users[name])
+		sort.Strings(children[name])
+		for _, child := range children[name] {
+			walk(child, depth+1)
+		}
+	}
+	walk(s.Name, 0)
+	sender.Say("007 %s :End of MAP", sender.Nick)
+}
@@ -0,0 +1,170 @@
+package irc_go_test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/fatlotus/fast-irc-golang"
+)
+
+func startLinkedServer(t *testing.T, name string) (*Server, string) {
+	s := NewServer()
+	s.Name = name
+	s.Password = "sekrit"
+	if err := s.Listen("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	return s, s.Listener.Addr().String()
+}
+
+func waitForServers(t *testing.T, s *Server, n int) {
+	for i := 0; s.Stats().Servers != n; i++ {
+		if i > 1000 {
+			t.Fatalf("%s sees %d servers, not %d", s.Name, s.Stats().Servers, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLinking(t *testing.T) {
+	a, addrA := startLinkedServer(t, "a.example")
+	defer a.Listener.Close()
+	b, addrB := startLinkedServer(t, "b.example")
+	defer b.Listener.Close()
+	c, _ := startLinkedServer(t, "c.example")
+	defer c.Listener.Close()
+
+	a.Links = map[string]LinkConfig{"b.example": {Password: "ab"}}
+	b.Links = map[string]LinkConfig{
+		"a.example": {Address: addrA, Password: "ab"},
+		"c.example": {Password: "bc"},
+	}
+	c.Links = map[string]LinkConfig{"b.example": {Address: addrB, Password: "bc"}}
+
+	clients := []*Client{}
+	for _, user := range []struct{ nick, addr string }{
+		{"alice", addrA}, {"bob", addrB}, {"dup", addrA}, {"dup", addrB},
+	} {
+		client, err := NewClient(user.nick, user.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+	alice, bob := clients[0], clients[1]
+	alice.Join("#chan")
+	bob.Join("#chan")
+
+	// Bursts announce each side's members, and both users holding a nick
+	// are killed.
+	if err := b.Connect("a.example"); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, alice, ":bob!u@h JOIN #chan")
+	readUntil(t, bob, ":alice!u@h JOIN #chan")
+	readUntil(t, clients[2], "Nick collision")
+	readUntil(t, clients[3], "Nick collision")
+
+	bob.PrivMsg("#chan", "hello from b")
+	bob.PrivMsg("alice", "psst")
+	bob.Writer.Flush()
+	readUntil(t, alice, "PRIVMSG #chan :hello from b")
+	readUntil(t, alice, "PRIVMSG alice :psst")
+
+	fmt.Fprintf(alice.Writer, "MODE #chan +v bob\r\nTOPIC #chan :linked\r\n")
+	alice.Writer.Flush()
+	readUntil(t, bob, "MODE #chan +v bob")
+	readUntil(t, bob, "TOPIC #chan :linked")
+
+	// A third server joins behind b, and hears about everyone.
+	if err := c.Connect("b.example"); err != nil {
+		t.Fatal(err)
+	}
+	waitForServers(t, a, 3)
+	carol, err := NewClient("carol", c.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer carol.Close()
+	carol.Join("#chan")
+	readUntil(t, alice, ":carol!u@h JOIN #chan")
+	fmt.Fprintf(carol.Writer, "NAMES #chan\r\n")
+	carol.Writer.Flush()
+	if line := readUntil(t, carol, "353"); !strings.Contains(line, "@alice") ||
+		!strings.Contains(line, "@bob") {
+		t.Errorf("unexpected NAMES reply %q", line)
+	}
+	// The burst carries who set the topic.
+	fmt.Fprintf(carol.Writer, "TOPIC #chan\r\n")
+	carol.Writer.Flush()
+	readUntil(t, carol, "332 carol #chan :linked")
+	readUntil(t, carol, "333 carol #chan alice!alice@127.0.0.1 ")
+
+	fmt.Fprintf(alice.Writer, "LUSERS\r\nLINKS\r\nMAP\r\n")
+	alice.Writer.Flush()
+	readUntil(t, alice, "There are 3 users and 0 services on 3 servers")
+	readUntil(t, alice, "I have 1 clients and 1 servers")
+	readUntil(t, alice, "364 alice c.example b.example :2 ")
+	readUntil(t, alice, "006 alice :a.example [1]")
+	readUntil(t, alice, "006 alice :`-b.example [1]")
+	readUntil(t, alice, "006 alice :  `-c.example [1]")
+
+	// WALLOPS reach +w users on every server.
+	fmt.Fprintf(bob.Writer, "MODE bob +w\r\n")
+	bob.Writer.Flush()
+	readUntil(t, bob, "MODE bob :+w")
+	fmt.Fprintf(carol.Writer, "MODE carol +w\r\n")
+	carol.Writer.Flush()
+	readUntil(t, carol, "MODE carol :+w")
+	fmt.Fprintf(alice.Writer, "OPER alice sekrit\r\nWALLOPS :network-wide\r\n")
+	alice.Writer.Flush()
+	readUntil(t, bob, ":alice!u@h WALLOPS :network-wide")
+	readUntil(t, carol, ":alice!u@h WALLOPS :network-wide")
+
+	// Splitting b off takes c with it.
+	fmt.Fprintf(alice.Writer, "SQUIT b.example :bye\r\n")
+	alice.Writer.Flush()
+	quits := map[string]bool{
+		":bob!u@h QUIT :a.example b.example":   true,
+		":carol!u@h QUIT :b.example c.example": true,
+	}
+	for len(quits) > 0 {
+		line := strings.TrimSpace(readUntil(t, alice, "QUIT"))
+		if !quits[line] {
+			t.Fatalf("unexpected %q", line)
+		}
+		delete(quits, line)
+	}
+	readUntil(t, bob, ":alice!u@h QUIT :b.example a.example")
+	waitForServers(t, a, 1)
+	waitForServers(t, b, 2)
+}
+
+func TestConnectFailed(t *testing.T) {
+	s, addr := startLinkedServer(t, "a.example")
+	defer s.Listener.Close()
+
+	// Nothing is listening where b is supposed to be.
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	s.Links = map[string]LinkConfig{
+		"b.example": {Address: l.Addr().String(), Password: "ab"},
+	}
+
+	alice, err := NewClient("alice", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	fmt.Fprintf(alice.Writer, "OPER alice sekrit\r\nCONNECT b.example\r\n")
+	alice.Writer.Flush()
+	readUntil(t, alice, "NOTICE alice :Connect to b.example failed")
+}
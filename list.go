@@ -0,0 +1,184 @@
+package irc_go
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How many rooms LIST looks at each time it takes the server lock. Replies
+// are written between pages, with no lock held, so that a slow client
+// listing many rooms doesn't hold up everyone else.
+const listPageSize = 100
+
+// What LIST was asked for: rooms matching any of Masks (or any at all, if
+// there are none) and none of Exclude, of which every condition holds. The
+// conditions are those of ELIST=CMNTU.
+type ListQuery struct {
+	Masks   []string
+	Exclude []string
+
+	// Bounds on the number of users, ignored when zero.
+	MoreThan, FewerThan int
+
+	// Bounds on when the room was created and its topic last set, ignored
+	// when zero. Rooms without a topic fail any bound on the latter.
+	CreatedAfter, CreatedBefore time.Time
+	TopicAfter, TopicBefore     time.Time
+}
+
+// Parses a comma-separated list of masks and conditions, such as
+// "#go*,!#go-nuts,>10,T<60". Times are in minutes before now. Anything that
+// isn't a well-formed condition is taken as a mask.
+func ParseListQuery(query string, now time.Time) *ListQuery {
+	q := &ListQuery{}
+	for _, item := range strings.Split(query, ",") {
+		if item == "" {
+			continue
+		}
+		if q.parseCondition(item, now) {
+			continue
+		}
+		if item[0] == '!' {
+			q.Exclude = append(q.Exclude, item[1:])
+		} else {
+			q.Masks = append(q.Masks, item)
+		}
+	}
+	return q
+}
+
+func (q *ListQuery) parseCondition(item string, now time.Time) bool {
+	var after, before *time.Time
+	switch item[0] {
+	case 'C', 'c':
+		after, before = &q.CreatedAfter, &q.CreatedBefore
+	case 'T', 't':
+		after, before = &q.TopicAfter, &q.TopicBefore
+	}
+	if after != nil {
+		item = item[1:]
+	}
+	if len(item) < 2 || item[0] != '<' && item[0] != '>' {
+		return false
+	}
+	n, err := strconv.Atoi(item[1:])
+	if err != nil || n < 0 {
+		return false
+	}
+
+	switch {
+	case after != nil && item[0] == '<':
+		*after = now.Add(-time.Duration(n) * time.Minute)
+	case after != nil:
+		*before = now.Add(-time.Duration(n) * time.Minute)
+	case item[0] == '>':
+		q.MoreThan = n
+	default:
+		q.FewerThan = n
+	}
+	return true
+}
+
+func (q *ListQuery) MatchesName(name string) bool {
+	for _, mask := range q.Exclude {
+		if MatchMask(mask, name) {
+			return false
+		}
+	}
+	if len(q.Masks) == 0 {
+		return true
+	}
+	for _, mask := range q.Masks {
+		if MatchMask(mask, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Must be called with the room at least read-locked.
+func (q *ListQuery) MatchesRoom(room *Room) bool {
+	users := len(room.Members)
+	if q.MoreThan > 0 && users <= q.MoreThan ||
+		q.FewerThan > 0 && users >= q.FewerThan {
+		return false
+	}
+	if !q.CreatedAfter.IsZero() && !room.Created.After(q.CreatedAfter) ||
+		!q.CreatedBefore.IsZero() && !room.Created.Before(q.CreatedBefore) {
+		return false
+	}
+	if q.TopicAfter.IsZero() && q.TopicBefore.IsZero() {
+		return true
+	}
+	if room.Topic == "" {
+		return false
+	}
+	return (q.TopicAfter.IsZero() || room.TopicTime.After(q.TopicAfter)) &&
+		(q.TopicBefore.IsZero() || room.TopicTime.Before(q.TopicBefore))
+}
+
+type listEntry struct {
+	name  string
+	users int
+	topic string
+}
+
+// Answers LIST with the rooms matching query, which may be empty.
+func (s *Server) ListChannels(sender *Peer, query string) error {
+	q := ParseListQuery(query, time.Now())
+
+	s.RLock()
+	names := []string{}
+	for name := range s.Rooms {
+		if q.MatchesName(name) {
+			names = append(names, name)
+		}
+	}
+	s.RUnlock()
+
+	sender.Say("321 %s Channel :Users  Name", sender.Nick)
+	for len(names) > 0 {
+		page := names
+		if len(page) > listPageSize {
+			page = page[:listPageSize]
+		}
+		names = names[len(page):]
+
+		for _, entry := range s.listPage(sender, page, q) {
+			topic := entry.topic
+			if topic == "" {
+				topic = "No topic set"
+			}
+			sender.Say("322 %s %s %d :%s", sender.Nick, entry.name, entry.users, topic)
+		}
+	}
+	sender.Say("323 %s :End of LIST", sender.Nick)
+
+	return nil
+}
+
+func (s *Server) ListAllChannels(sender *Peer) error {
+	return s.ListChannels(sender, "")
+}
+
+// Looks up the named rooms that sender may see and query accepts, skipping
+// any that have since gone.
+func (s *Server) listPage(sender *Peer, names []string, q *ListQuery) []listEntry {
+	s.RLock()
+	defer s.RUnlock()
+
+	entries := make([]listEntry, 0, len(names))
+	for _, name := range names {
+		room, ok := s.Rooms[name]
+		if !ok {
+			continue
+		}
+		room.RLock()
+		if !room.IsHiddenFrom(sender) && q.MatchesRoom(room) {
+			entries = append(entries, listEntry{name, len(room.Members), room.Topic})
+		}
+		room.RUnlock()
+	}
+	return entries
+}
@@ -0,0 +1,109 @@
+package irc_go_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/fatlotus/fast-irc-golang"
+)
+
+func TestListQuery(t *testing.T) {
+	now := time.Now()
+	q := ParseListQuery("#go*,!#go-nuts,>1,<4,C>10,T<60", now)
+
+	for name, want := range map[string]bool{
+		"#golang":  true,
+		"#GOPHERS": true,
+		"#go-nuts": false,
+		"#rust":    false,
+	} {
+		if q.MatchesName(name) != want {
+			t.Errorf("MatchesName(%q) = %v", name, !want)
+		}
+	}
+
+	room := func(users int, created, topicSet time.Duration, topic string) *Room {
+		r := &Room{
+			Members:   map[int]*Member{},
+			Created:   now.Add(-created),
+			Topic:     topic,
+			TopicTime: now.Add(-topicSet),
+		}
+		for i := 0; i < users; i++ {
+			r.Members[i] = &Member{}
+		}
+		return r
+	}
+	for i, c := range []struct {
+		room *Room
+		want bool
+	}{
+		{room(2, time.Hour, time.Minute, "hi"), true},
+		{room(1, time.Hour, time.Minute, "hi"), false},
+		{room(4, time.Hour, time.Minute, "hi"), false},
+		{room(3, 5*time.Minute, time.Minute, "hi"), false},
+		{room(3, time.Hour, 2*time.Hour, "hi"), false},
+		{room(3, time.Hour, time.Minute, ""), false},
+	} {
+		if q.MatchesRoom(c.room) != c.want {
+			t.Errorf("case %d: MatchesRoom = %v", i, !c.want)
+		}
+	}
+
+	if q := ParseListQuery("", now); !q.MatchesName("#any") || !q.MatchesRoom(room(0, 0, 0, "")) {
+		t.Error("an empty query should match everything")
+	}
+}
+
+func TestList(t *testing.T) {
+	s := NewServer()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewPipeClient("a", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	for _, name := range []string{"#golang", "#gophers", "#rust"} {
+		send(a, "JOIN %s", name)
+		readUntil(t, a, "366 a "+name)
+	}
+	send(a, "TOPIC #gophers :Gophers")
+	readUntil(t, a, "TOPIC #gophers")
+
+	// Masks may leave channels out, and the list is bracketed by 321 and
+	// 323.
+	b, err := NewPipeClient("b", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	send(b, "LIST #go*,!#golang")
+	readUntil(t, b, "321 b Channel :Users  Name")
+	readUntilWithout(t, b, "322 b #gophers 1 :Gophers", "#golang")
+	readUntilWithout(t, b, "323 b :End of LIST", "322")
+
+	send(b, "JOIN #rust")
+	readUntil(t, b, "366 b #rust")
+	send(b, "LIST >1")
+	readUntil(t, b, "322 b #rust 2 :No topic set")
+	readUntilWithout(t, b, "323 b", "322")
+
+	send(b, "LIST T<5")
+	readUntil(t, b, "322 b #gophers 1")
+	readUntilWithout(t, b, "323 b", "322")
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Stop(context.Background())
+	}()
+	readUntil(t, a, "ERROR")
+	readUntil(t, b, "ERROR")
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,34 @@
+package irc_go
+
+import (
+	"strings"
+)
+
+// Reports whether subject matches the glob-style mask, where '*' matches any
+// run of characters and '?' matches exactly one. Comparison is case
+// insensitive, as with nicknames.
+func MatchMask(mask, subject string) bool {
+	mask = strings.ToLower(mask)
+	subject = strings.ToLower(subject)
+
+	star, restart := -1, 0
+	i, j := 0, 0
+	for j < len(subject) {
+		if i < len(mask) && (mask[i] == '?' || mask[i] == subject[j]) {
+			i++
+			j++
+		} else if i < len(mask) && mask[i] == '*' {
+			star, restart = i, j
+			i++
+		} else if star >= 0 {
+			restart++
+			i, j = star+1, restart
+		} else {
+			return false
+		}
+	}
+	for i < len(mask) && mask[i] == '*' {
+		i++
+	}
+	return i == len(mask)
+}
@@ -0,0 +1,166 @@
+package irc_go
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Lines waiting to be written to a peer. Queueing never blocks: a goroutine
+// is started to write the queue out only while there is something in it, so
+// an idle peer costs none, and a full queue refuses more instead of making
+// the sender wait.
+type SendQueue struct {
+	w    io.Writer
+	size int
+
+	mu      sync.Mutex
+	idle    sync.Cond
+	pending []queuedLine
+	writing bool
+	closed  bool
+	err     error
+
+	// Kept between batches by the writing goroutine, so that starting one
+	// and writing a batch allocate nothing.
+	drainFunc func()
+	spare     []queuedLine
+	bufs      net.Buffers
+	unwritten net.Buffers
+}
+
+type queuedLine struct {
+	buf []byte
+	// Released once buf has been written, if it's shared.
+	shared *sharedBuf
+}
+
+// Holds up to size lines for w.
+func NewSendQueue(w io.Writer, size int) *SendQueue {
+	q := &SendQueue{w: w, size: size}
+	q.idle.L = &q.mu
+	q.drainFunc = q.drain
+	return q
+}
+
+// Queues buf, which must not be modified afterwards. Returns false only if
+// the queue is full; once it has been closed, or writing has failed, lines
+// are quietly dropped.
+func (q *SendQueue) WriteAsync(buf []byte) bool {
+	return q.push(queuedLine{buf: buf})
+}
+
+func (q *SendQueue) push(line queuedLine) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed || q.err != nil {
+		if line.shared != nil {
+			line.shared.release()
+		}
+		return true
+	}
+	if len(q.pending) >= q.size {
+		return false
+	}
+	q.pending = append(q.pending, line)
+	if !q.writing {
+		q.writing = true
+		go q.drainFunc()
+	}
+	return true
+}
+
+// Writes out whatever is queued, a batch at a time, until nothing is left.
+func (q *SendQueue) drain() {
+	q.mu.Lock()
+	for len(q.pending) > 0 && q.err == nil {
+		batch := q.pending
+		q.pending = q.spare[:0]
+		q.mu.Unlock()
+
+		// Connections that support it take the whole batch in one writev.
+		q.bufs = q.bufs[:0]
+		for _, line := range batch {
+			q.bufs = append(q.bufs, line.buf)
+		}
+		q.unwritten = q.bufs
+		_, err := q.unwritten.WriteTo(q.w)
+		releaseLines(batch)
+
+		q.mu.Lock()
+		q.spare = batch[:0]
+		if err != nil {
+			q.err = err
+		}
+	}
+	releaseLines(q.pending)
+	q.pending = q.pending[:0]
+	q.writing = false
+	q.idle.Broadcast()
+	q.mu.Unlock()
+}
+
+func releaseLines(lines []queuedLine) {
+	for i, line := range lines {
+		if line.shared != nil {
+			line.shared.release()
+		}
+		lines[i] = queuedLine{}
+	}
+}
+
+// How many lines are waiting to be written.
+func (q *SendQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Waits for everything already queued to be written, and drops anything
+// queued afterwards. Returns the first error writing hit, if any.
+func (q *SendQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	for q.writing {
+		q.idle.Wait()
+	}
+	return q.err
+}
+
+// An encoded line that may be waiting in many send queues at once. It goes
+// back to bufPool once its owner and every queue holding it have let go.
+type sharedBuf struct {
+	b    []byte
+	refs int32
+}
+
+// Lines longer than this aren't worth keeping for reuse.
+const maxPooledLine = 1024
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return &sharedBuf{b: make([]byte, 0, 512)}
+	},
+}
+
+// Returns an empty buffer with one reference, held by the caller.
+func newSharedBuf() *sharedBuf {
+	sb := bufPool.Get().(*sharedBuf)
+	sb.b = sb.b[:0]
+	sb.refs = 1
+	return sb
+}
+
+func (sb *sharedBuf) retain() {
+	atomic.AddInt32(&sb.refs, 1)
+}
+
+func (sb *sharedBuf) release() {
+	if atomic.AddInt32(&sb.refs, -1) == 0 && cap(sb.b) <= maxPooledLine {
+		bufPool.Put(sb)
+	}
+}
@@ -2,17 +2,15 @@ package irc_go
 
 import (
 	"bufio"
-	"fmt"
 	"log"
 	"net"
 	"os"
-
-	"github.com/fatlotus/batchwriter"
+	"sync"
 )
 
 type Peer struct {
 	Conn   net.Conn
-	Output *batchwriter.Writer
+	Output *SendQueue
 
 	Key    int
 	Server *Server
@@ -20,12 +18,41 @@ type Peer struct {
 	Nick     string
 	User     string
 	FullName string
+	Host     string
 	Away     string
+	Account  string
+
+	// The address the peer connected from, which unlike Host isn't changed
+	// by CHGHOST.
+	Addr string
 
-	IsModOf          []string
 	IsGlobalOperator bool
+	UserModes        UserModes
 
 	SentWelcome bool
+
+	// IRCv3 capabilities the client has enabled, and whether it has begun
+	// (but not ended) negotiating them, which holds off registration. Caps
+	// is guarded by CapsLock, since other peers' messages consult it.
+	Caps           map[string]bool
+	CapsLock       sync.RWMutex
+	CapNegotiating bool
+
+	// Input read from the connection but not yet handled, carried across a
+	// handoff.
+	Pending []byte
+	// Set once the send queue has filled up, when the peer is disconnected.
+	overflowed uint32
+
+	// Sent with PASS, to authenticate a server link.
+	Password string
+	// For a connection to another server: its name (once known, or when
+	// we connected to it) and, once the handshake is done, its place on the
+	// network.
+	LinkName  string
+	Neighbour *RemoteServer
+	// For a user connected to another server, that server.
+	Origin *RemoteServer
 }
 
 func (p *Peer) NickOrAsterix() string {
@@ -36,6 +63,17 @@ func (p *Peer) NickOrAsterix() string {
 	}
 }
 
+func (p *Peer) Hostmask() string {
+	return p.Nick + "!" + p.User + "@" + p.Host
+}
+
+// Whether mask matches the peer's hostmask, or the same with the address it
+// connected from in place of its host.
+func (p *Peer) MatchesMask(mask string) bool {
+	return MatchMask(mask, p.Hostmask()) ||
+		p.Addr != "" && p.Addr != p.Host && MatchMask(mask, p.Nick+"!"+p.User+"@"+p.Addr)
+}
+
 func (p *Peer) SendMotd() {
 	motd, err := os.Open(p.Server.MessageOfTheDayPath)
 	if err != nil {
@@ -59,193 +97,64 @@ func (p *Peer) SendMotd() {
 }
 
 func (p *Peer) Route(cmd string, args []string, message string) error {
-	switch cmd {
-	case "NICK":
-		if len(args) == 0 {
-			return &NoNickSpecified{}
-		}
-		if err := p.Server.SetNick(p, args[0]); err != nil {
-			return err
-		}
-		p.MaybeSendWelcome()
-		return nil
-	case "USER":
-		if len(args) < 3 || message == "" {
-			return fmt.Errorf("461 %s USER :Not enough parameters",
-				p.NickOrAsterix())
-		}
-		p.User = args[0]
-		p.FullName = message
-		p.MaybeSendWelcome()
-		return nil
-	case "MOTD":
-		p.SendMotd()
-		return nil
-	case "PRIVMSG", "NOTICE":
-		if p.Nick != "" && p.User != "" {
-			err := error(nil)
-			if len(args) == 0 {
-				err = &NoRecipient{p.NickOrAsterix()}
-			} else if message == "" {
-				err = &NoMessage{p.NickOrAsterix()}
-			} else {
-				err = p.Server.SendMessage(cmd, p, args[0], message)
-			}
-			if cmd == "PRIVMSG" && err != nil {
-				return err
-			}
-			return nil
+	c, ok := p.Server.Commands[cmd]
+	if m := p.Server.Metrics; m != nil {
+		if ok {
+			m.countCommand(cmd)
 		} else {
-			return &NotRegistered{p.NickOrAsterix()}
-		}
-	case "AWAY":
-		if p.Nick != "" && p.User != "" {
-			p.Server.SetAway(p, message)
-			if message != "" {
-				p.Say("306 %s :You have been marked as being away", p.Nick)
-			} else {
-				p.Say("305 %s :You are no longer marked as being away", p.Nick)
-			}
-		}
-	case "JOIN":
-		if p.Nick != "" && p.User != "" {
-			if len(args) == 1 {
-				return p.Server.Join(p, args[0])
-			} else {
-				return &NeedsMoreParams{p.Nick, "JOIN"}
-			}
-		}
-	case "PART":
-		if p.Nick != "" && p.User != "" {
-			if len(args) == 1 {
-				return p.Server.Part(p, args[0], message)
-			} else {
-				return &NeedsMoreParams{p.Nick, "PART"}
-			}
-		}
-	case "NAMES":
-		if p.Nick != "" && p.User != "" {
-			if len(args) == 1 {
-				return p.Server.SendNames(p, args[0])
-			} else {
-				return p.Server.SendAllNames(p)
-			}
+			m.countCommand("unknown")
 		}
-	case "LIST":
-		if p.Nick != "" && p.User != "" {
-			if len(args) == 1 {
-				return p.Server.ListChannels(p, args[0])
-			} else {
-				return p.Server.ListAllChannels(p)
-			}
-		}
-	case "WHO":
-		if p.Nick != "" && p.User != "" {
-			if len(args) == 1 {
-				if args[0] == "*" {
-					return p.Server.WhoAll(p)
-				} else {
-					return p.Server.Who(p, args[0])
-				}
-			} else {
-				return &NeedsMoreParams{p.Nick, "WHO"}
-			}
-		}
-	case "MODE":
-		if p.Nick != "" && p.User != "" {
-			if len(args) == 3 {
-				return p.Server.SetMembershipMode(p, args[0], args[1], args[2])
-			} else if len(args) == 2 {
-				return p.Server.SetMode(p, args[0], args[1])
-			} else if len(args) == 1 {
-				return p.Server.GetMode(p, args[0])
-			} else {
-				return &NeedsMoreParams{p.Nick, "MODE"}
-			}
+	}
+	if !ok {
+		if p.SentWelcome {
+			return &UnknownCommand{p.NickOrAsterix(), cmd}
 		}
 		return nil
-	case "TOPIC":
-		if p.Nick != "" && p.User != "" {
-			if len(args) == 1 {
-				if message != "" {
-					return p.Server.SetTopic(p, args[0], message)
-				} else {
-					topic, err := p.Server.GetTopic(p, args[0])
-					if err != nil {
-						return err
-					}
-					if topic != "" {
-						p.Say("332 %s %s :%s", p.Nick, args[0], topic)
-					} else {
-						p.Say("331 %s %s :%s", p.Nick, args[0],
-							"No topic is set")
-					}
-					return nil
-				}
-			} else {
-				return &NeedsMoreParams{p.Nick, "TOPIC"}
-			}
+	}
+	if c.Registered && !p.IsRegistered() {
+		if c.RejectUnregistered {
+			return &NotRegistered{p.NickOrAsterix()}
 		}
-	case "PING":
-		p.Say("PONG %s", p.NickOrAsterix())
-	case "PONG":
 		return nil
-	case "LUSERS":
-		p.SendUserList()
-	case "OPER":
-		if p.Nick != "" && p.User != "" {
-			if len(args) == 2 {
-				if p.Server.Password == args[1] {
-					p.Say("381 %s :You are now an IRC operator", p.Nick)
-					p.IsGlobalOperator = true
-				} else {
-					return &IncorrectPassword{p.Nick}
-				}
-			} else {
-				return &NeedsMoreParams{p.Nick, "OPER"}
-			}
-		}
-	case "WHOIS":
-		if len(args) == 0 {
-			return nil
-		}
-		return p.Server.Whois(p, args[0])
-	case "QUIT":
-		return p.Server.Quit(p, message)
-	default:
-		if p.SentWelcome {
-			return &UnknownCommand{p.NickOrAsterix(), cmd}
-		}
 	}
-
-	return nil
+	if len(args) < c.MinParams {
+		return &NeedsMoreParams{p.NickOrAsterix(), cmd}
+	}
+	return c.Handler(p, args, message)
 }
 
 func (p *Peer) SendUserList() {
-	users := p.Server.NumUsers()
-	clients := p.Server.NumClients()
-	ops := p.Server.NumOps()
-
-	p.Say("251 %s :There are %d users and 0 services on 1 servers",
-		p.Nick, users)
-	p.Say("252 %s %d :operator(s) online", p.Nick, ops)
-	p.Say("253 %s %d :unknown connection(s)", p.Nick, clients-users)
-	p.Say("254 %s %d :channels formed", p.Nick, len(p.Server.Rooms))
-	p.Say("255 %s :I have %d clients and 0 servers", p.Nick, clients)
+	stats := p.Server.Stats()
+
+	p.Say("251 %s :There are %d users and %d services on %d servers",
+		p.Nick, stats.Users, len(p.Server.Services), stats.Servers)
+	p.Say("252 %s %d :operator(s) online", p.Nick, stats.Operators)
+	p.Say("253 %s %d :unknown connection(s)", p.Nick, stats.Clients-stats.LocalUsers)
+	p.Say("254 %s %d :channels formed", p.Nick, stats.Channels)
+	p.Say("255 %s :I have %d clients and %d servers", p.Nick, stats.Clients, stats.Links)
 }
 
-func (p *Peer) MaybeSendWelcome() {
-	if p.Nick != "" && p.User != "" && !p.SentWelcome {
+func (p *Peer) MaybeSendWelcome() error {
+	if p.Nick != "" && p.User != "" && !p.SentWelcome && !p.CapNegotiating {
+		if err := p.Server.RegisteredUser(p); err != nil {
+			return err
+		}
 		p.SentWelcome = true
-		p.Server.RegisteredUser(p)
 
 		p.Say("001 %s :Welcome to the Internet Relay Network %s!%s@foo",
 			p.Nick, p.Nick, p.User)
 		p.Say("002 %s :TBD", p.Nick)
 		p.Say("003 %s :TBD", p.Nick)
 		p.Say("004 %s 1 2 3 4", p.Nick)
+		p.Server.RLock()
+		topicLen := p.Server.topicLen()
+		p.Server.RUnlock()
+		p.Say("005 %s PREFIX=(%s)%s CHANTYPES=# BOT=B ELIST=CMNTU TOPICLEN=%d :are supported by this server",
+			p.Nick, PrefixModes, PrefixSymbols, topicLen)
 
 		p.SendUserList()
 		p.SendMotd()
+		p.Server.registered(p)
 	}
+	return nil
 }
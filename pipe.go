@@ -0,0 +1,101 @@
+package irc_go
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Serves a peer over rwc as though it had connected to a listener, so that
+// a server can be embedded in-process or driven by tests without TCP. Peers
+// attached this way cannot be passed along by HandOff unless rwc is a socket.
+func (s *Server) Attach(rwc io.ReadWriteCloser) (*Peer, error) {
+	conn, ok := rwc.(net.Conn)
+	if !ok {
+		conn = streamConn(rwc)
+	}
+
+	s.Lock()
+	if s.Closing != "" || s.Handover != nil {
+		s.Unlock()
+		conn.Close()
+		return nil, ErrServerClosed
+	}
+	if s.Limits.MaxClients > 0 && len(s.Peers) >= s.Limits.MaxClients {
+		s.Unlock()
+		go func() {
+			fmt.Fprintf(conn, "ERROR :Closing Link: (Server is full)\r\n")
+			conn.Close()
+		}()
+		return nil, ErrServerFull
+	}
+	if err := s.admit(conn.RemoteAddr()); err != nil {
+		s.Unlock()
+		go func() {
+			fmt.Fprintf(conn, "%s\r\n", err)
+			conn.Close()
+		}()
+		return nil, err
+	}
+	p := s.addPeer(conn, hostOf(conn.RemoteAddr()))
+	s.Unlock()
+
+	if !s.connected(p) {
+		return nil, ErrConnectionRefused
+	}
+	s.readFrom(p)
+	return p, nil
+}
+
+// Attaches one end of an in-memory pipe as a new peer and returns the other,
+// from which a client reads and writes as over a real connection. The pipe
+// is unbuffered, so a client that stops reading is disconnected as soon as
+// SendQueueLen lines are waiting for it.
+func (s *Server) Pipe() (net.Conn, error) {
+	client, server := net.Pipe()
+	if _, err := s.Attach(server); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// Gives rwc the deadlines of a net.Conn, which Shutdown and HandOff use to
+// interrupt readers, by copying it to and from one end of a net.Pipe.
+func streamConn(rwc io.ReadWriteCloser) net.Conn {
+	conn, end := net.Pipe()
+	go func() {
+		io.Copy(end, rwc)
+		end.Close()
+	}()
+	go func() {
+		io.Copy(rwc, end)
+		rwc.Close()
+	}()
+	return conn
+}
+
+// Serves each listener in the background until Stop is called. Peers can
+// also be added with Attach, so no listener is needed at all.
+func (s *Server) Start(listeners ...net.Listener) error {
+	if s.ShutdownReason() != "" {
+		return ErrServerClosed
+	}
+	for _, ln := range listeners {
+		s.serving.Add(1)
+		go func(ln net.Listener) {
+			defer s.serving.Done()
+			s.ServeListener(ln)
+		}(ln)
+	}
+	return nil
+}
+
+// Shuts the server down as Shutdown does, then waits for the accept loops
+// begun by Start to return.
+func (s *Server) Stop(ctx context.Context) error {
+	err := s.shutdown(ctx, "Server shutting down")
+	s.serving.Wait()
+	return err
+}
@@ -0,0 +1,101 @@
+package irc_go_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/fatlotus/fast-irc-golang"
+)
+
+// An io.ReadWriteCloser that is not a net.Conn.
+type stream struct {
+	io.Reader
+	io.WriteCloser
+}
+
+func TestPipe(t *testing.T) {
+	s := NewServer()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewPipeClient("a", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if a.Conn.RemoteAddr().String() != "pipe" {
+		t.Errorf("unexpected address %s", a.Conn.RemoteAddr())
+	}
+	a.Join("#chan")
+
+	// Attach a peer over a pair of plain pipes.
+	in, toServer := io.Pipe()
+	fromServer, out := io.Pipe()
+	if _, err := s.Attach(stream{in, out}); err != nil {
+		t.Fatal(err)
+	}
+	b := &Client{Reader: bufio.NewReader(fromServer)}
+	go io.WriteString(toServer, "NICK b\r\nUSER b * * :b\r\nJOIN #chan\r\n")
+	readUntil(t, b, "JOIN #chan")
+	readUntil(t, a, ":b!u@h JOIN #chan")
+
+	a.PrivMsg("#chan", "hello")
+	a.Writer.Flush()
+	if line := readUntil(t, b, "PRIVMSG"); !strings.Contains(line, "PRIVMSG #chan :hello") {
+		t.Errorf("unexpected message %q", line)
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Stop(context.Background())
+	}()
+	readUntil(t, a, "ERROR :Closing Link: (Server shutting down)")
+	readUntil(t, b, "ERROR :Closing Link: (Server shutting down)")
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("expected the stream to be closed, got %v", err)
+	}
+
+	if _, err := s.Pipe(); err != ErrServerClosed {
+		t.Errorf("expected ErrServerClosed, got %v", err)
+	}
+	if err := s.Start(); err != ErrServerClosed {
+		t.Errorf("expected ErrServerClosed, got %v", err)
+	}
+}
+
+func TestUnixListener(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	ln, err := net.Listen("unix", tmpdir+"/irc.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	if err := s.Start(ln); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.Background())
+
+	conn, err := net.Dial("unix", tmpdir+"/irc.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &Client{Conn: conn, Reader: bufio.NewReader(conn)}
+	io.WriteString(conn, "NICK a\r\nUSER a * * :a\r\n")
+	readUntil(t, c, " 001 a ")
+}
@@ -0,0 +1,72 @@
+package irc_go
+
+import (
+	"errors"
+	"runtime"
+	"time"
+)
+
+var errCannotPoll = errors.New("irc: connection cannot be polled")
+
+// Starts reading a peer's input: from a shared poller when UseEpoll is set
+// and the platform and connection allow it, and otherwise on a goroutine of
+// its own. The caller must already have counted the peer in Handlers.
+func (s *Server) readFrom(p *Peer) {
+	if s.UseEpoll {
+		if pl, err := s.pollerFor(p); err == nil && pl.watch(p) == nil {
+			return
+		}
+	}
+	go p.HandleInput()
+}
+
+// Picks the poller that reads p, starting one per CPU the first time.
+func (s *Server) pollerFor(p *Peer) (*poller, error) {
+	s.pollLock.Lock()
+	defer s.pollLock.Unlock()
+
+	if s.pollers == nil {
+		for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+			pl, err := newPoller(s)
+			if err != nil {
+				return nil, err
+			}
+			s.pollers = append(s.pollers, pl)
+		}
+	}
+	return s.pollers[p.Key%len(s.pollers)], nil
+}
+
+// Makes every poller let go of its peers, as a read deadline interrupts
+// HandleInput.
+func (s *Server) interruptPollers() {
+	s.pollLock.Lock()
+	defer s.pollLock.Unlock()
+
+	for _, pl := range s.pollers {
+		pl.interrupt()
+	}
+}
+
+// Makes p's reader stop and hang up, as though the connection had dropped.
+// Anything already queued for p is still sent.
+func (s *Server) interruptReader(p *Peer) {
+	if p.Conn == nil {
+		return
+	}
+	p.Conn.SetReadDeadline(time.Now())
+
+	s.pollLock.Lock()
+	defer s.pollLock.Unlock()
+
+	if len(s.pollers) > 0 {
+		s.pollers[p.Key%len(s.pollers)].drop(p)
+	}
+}
+
+// Closes p's connection, and has its poller let go of it too: a closed
+// connection raises no more epoll events, and its fd may soon be reused.
+func (s *Server) closeConn(p *Peer) {
+	p.Conn.Close()
+	s.interruptReader(p)
+}
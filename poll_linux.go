@@ -0,0 +1,336 @@
+//go:build linux
+// +build linux
+
+package irc_go
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"sync"
+	"syscall"
+)
+
+// The longest partial line kept between reads; HandleLine truncates anything
+// longer anyway.
+const maxPartialLine = 512
+
+// Reads from many connections on one goroutine, waking only for those epoll
+// reports as readable, so that an idle peer costs neither a goroutine nor a
+// read buffer.
+//
+// Peers are known to epoll by a token of the poller's rather than their fd,
+// which may be reused by a later connection as soon as it's closed.
+type poller struct {
+	server    *Server
+	epfd      int
+	wake      [2]int
+	buf       []byte
+	peers     map[int32]*polledPeer
+	nextToken int32
+
+	// Guards the requests below, which other goroutines make by writing to
+	// the wake pipe.
+	mu       sync.Mutex
+	added    []*polledPeer
+	dropped  []*Peer
+	detach   bool
+	shutDown bool
+}
+
+type polledPeer struct {
+	*Peer
+	raw     syscall.RawConn
+	token   int32
+	partial []byte
+	long    bool
+}
+
+// The token of the wake pipe; peers' start from 1.
+const wakeToken = 0
+
+func newPoller(s *Server) (*poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	pl := &poller{
+		server: s,
+		epfd:   epfd,
+		buf:    make([]byte, 4096),
+		peers:  map[int32]*polledPeer{},
+	}
+	err = syscall.Pipe2(pl.wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC)
+	if err == nil {
+		ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: wakeToken}
+		err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, pl.wake[0], &ev)
+		if err != nil {
+			syscall.Close(pl.wake[0])
+			syscall.Close(pl.wake[1])
+		}
+	}
+	if err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+	go pl.run()
+	return pl, nil
+}
+
+// Hands p to the poller, which registers it on its own goroutine.
+func (pl *poller) watch(p *Peer) error {
+	sc, ok := p.Conn.(syscall.Conn)
+	if !ok {
+		return errCannotPoll
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.shutDown {
+		return errCannotPoll
+	}
+	pl.added = append(pl.added, &polledPeer{Peer: p, raw: raw})
+	pl.wakeUp()
+	return nil
+}
+
+func (pl *poller) interrupt() {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	pl.detach = true
+	pl.wakeUp()
+}
+
+// Lets go of p if this poller is reading it.
+func (pl *poller) drop(p *Peer) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	pl.dropped = append(pl.dropped, p)
+	pl.wakeUp()
+}
+
+// Must be called with pl.mu held.
+func (pl *poller) wakeUp() {
+	// The pipe is gone once the poller has finished; a full pipe already
+	// has a wake-up pending.
+	if !pl.shutDown {
+		syscall.Write(pl.wake[1], []byte{0})
+	}
+}
+
+func (pl *poller) run() {
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(pl.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			pl.fail(err)
+			return
+		}
+		for _, ev := range events[:n] {
+			if ev.Fd == wakeToken {
+				if !pl.handleRequests() {
+					return
+				}
+			} else if pp := pl.peers[ev.Fd]; pp != nil {
+				pl.read(pp)
+			}
+		}
+	}
+}
+
+// Gives up on epoll after an unexpected error, reading each of the poller's
+// peers on a goroutine of its own instead, as though UseEpoll were off.
+func (pl *poller) fail(err error) {
+	log.Printf("epoll failed, reading peers on goroutines instead: %s", err)
+
+	pl.mu.Lock()
+	pl.shutDown = true
+	added := pl.added
+	pl.added, pl.dropped = nil, nil
+	pl.mu.Unlock()
+
+	for _, pp := range pl.peers {
+		pl.remove(pp)
+		pp.Pending = append([]byte(nil), pp.partial...)
+		go pp.HandleInput()
+	}
+	for _, pp := range added {
+		go pp.HandleInput()
+	}
+	pl.close()
+}
+
+func (pl *poller) close() {
+	syscall.Close(pl.epfd)
+	syscall.Close(pl.wake[0])
+	syscall.Close(pl.wake[1])
+}
+
+// Registers newly added peers and lets go of every peer when interrupted,
+// returning false once the server has shut down and the poller is finished.
+func (pl *poller) handleRequests() bool {
+	var drain [64]byte
+	for {
+		if n, _ := syscall.Read(pl.wake[0], drain[:]); n < len(drain) {
+			break
+		}
+	}
+
+	pl.mu.Lock()
+	added, dropped, detach := pl.added, pl.dropped, pl.detach
+	pl.added, pl.dropped, pl.detach = nil, nil, false
+	pl.mu.Unlock()
+
+	for _, pp := range added {
+		pl.add(pp)
+	}
+	for _, p := range dropped {
+		for _, pp := range pl.peers {
+			if pp.Peer == p {
+				pl.remove(pp)
+				pp.endInput(io.EOF, pp.partial)
+				pp.Server.Handlers.Done()
+			}
+		}
+	}
+	if !detach {
+		return true
+	}
+
+	for _, pp := range pl.peers {
+		pl.remove(pp)
+		pp.endInput(io.EOF, pp.partial)
+		pp.Server.Handlers.Done()
+	}
+	if pl.server.ShutdownReason() == "" {
+		return true
+	}
+
+	pl.mu.Lock()
+	pl.shutDown = true
+	for _, pp := range pl.added {
+		go pp.HandleInput()
+	}
+	pl.added = nil
+	pl.mu.Unlock()
+	pl.close()
+	return false
+}
+
+func (pl *poller) add(pp *polledPeer) {
+	// A peer accepted mid-handoff is passed along before it reads anything.
+	if pp.Server.IsHandingOff() {
+		pp.Server.Handlers.Done()
+		return
+	}
+	pl.nextToken++
+	if pl.nextToken <= wakeToken {
+		pl.nextToken = wakeToken + 1
+	}
+	pp.token = pl.nextToken
+	ev := syscall.EpollEvent{
+		Events: syscall.EPOLLIN | syscall.EPOLLRDHUP,
+		Fd:     pp.token,
+	}
+	// Control holds the fd open, so it can't be closed and reused meanwhile.
+	var err error
+	if e := pp.raw.Control(func(fd uintptr) {
+		err = syscall.EpollCtl(pl.epfd, syscall.EPOLL_CTL_ADD, int(fd), &ev)
+	}); e != nil {
+		err = e
+	}
+	if err != nil {
+		go pp.HandleInput()
+		return
+	}
+	pl.peers[pp.token] = pp
+
+	if pending := pp.Pending; len(pending) > 0 {
+		pp.Pending = nil
+		pl.consume(pp, pending)
+	}
+}
+
+// Stops watching pp. A connection that has already been closed has left
+// epoll by itself, and its fd may belong to another by now.
+func (pl *poller) remove(pp *polledPeer) {
+	pp.raw.Control(func(fd uintptr) {
+		syscall.EpollCtl(pl.epfd, syscall.EPOLL_CTL_DEL, int(fd), nil)
+	})
+	delete(pl.peers, pp.token)
+}
+
+func (pl *poller) read(pp *polledPeer) {
+	n := 0
+	var err error
+	rerr := pp.raw.Read(func(fd uintptr) bool {
+		n, err = syscall.Read(int(fd), pl.buf)
+		return true
+	})
+	if rerr != nil {
+		err = rerr
+	}
+	if err == syscall.EAGAIN {
+		return
+	}
+	if err == nil && n == 0 {
+		err = io.EOF
+	}
+	if err != nil {
+		pl.remove(pp)
+		pp.endInput(err, pp.partial)
+		pp.Server.Handlers.Done()
+		return
+	}
+	pl.consume(pp, pl.buf[:n])
+}
+
+// Handles each complete line in data, keeping any trailing partial line
+// until the rest of it arrives.
+func (pl *poller) consume(pp *polledPeer, data []byte) {
+	if len(pp.partial) > 0 {
+		data = append(pp.partial, data...)
+	}
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		line := data[:i+1]
+		data = data[i+1:]
+		if !pp.long && pp.HandleLine(bytes.TrimRight(line, "\r\n")) {
+			pl.hangUp(pp)
+			return
+		}
+		pp.long = false
+	}
+
+	if len(data) >= maxPartialLine {
+		if !pp.long && pp.HandleLine(data) {
+			pl.hangUp(pp)
+			return
+		}
+		pp.long = true
+		data = nil
+	}
+	if len(data) == 0 {
+		pp.partial = nil
+	} else {
+		pp.partial = append(pp.partial[:0], data...)
+	}
+}
+
+func (pl *poller) hangUp(pp *polledPeer) {
+	pl.remove(pp)
+	pp.hangUp()
+	pp.Server.Handlers.Done()
+}
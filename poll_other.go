@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package irc_go
+
+import "errors"
+
+// Elsewhere, every peer reads its input on a goroutine of its own.
+type poller struct{}
+
+func newPoller(s *Server) (*poller, error) {
+	return nil, errors.New("irc: epoll is only available on Linux")
+}
+
+func (pl *poller) watch(p *Peer) error {
+	return errCannotPoll
+}
+
+func (pl *poller) interrupt() {}
+
+func (pl *poller) drop(p *Peer) {}
@@ -0,0 +1,113 @@
+package irc_go_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/fatlotus/fast-irc-golang"
+)
+
+func TestEpoll(t *testing.T) {
+	s := NewServer()
+	s.UseEpoll = true
+	if err := s.Listen("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	addr := s.Listener.Addr().String()
+
+	a, err := NewClient("a", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewClient("b", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	a.Join("#chan")
+	b.Join("#chan")
+
+	// Lines split across writes, and overlong ones, arrive whole.
+	fmt.Fprintf(a.Writer, "PRIV")
+	a.Writer.Flush()
+	fmt.Fprintf(a.Writer, "MSG #chan :split\r\nPRIVMSG #chan :%s\r\n", strings.Repeat("x", 1000))
+	a.Writer.Flush()
+	readUntil(t, b, "PRIVMSG #chan :split")
+	if line := readUntil(t, b, "PRIVMSG #chan :x"); len(line) > 512 {
+		t.Errorf("expected the long line to be truncated, got %d bytes", len(line))
+	}
+
+	fmt.Fprintf(b.Writer, "QUIT :bye\r\n")
+	b.Writer.Flush()
+	readUntil(t, a, "QUIT :bye")
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, a, "ERROR :Closing Link")
+	if s.NumClients() != 0 {
+		t.Errorf("leaked %d peers", s.NumClients())
+	}
+}
+
+func TestEpollSlowReader(t *testing.T) {
+	s := NewServer()
+	s.UseEpoll = true
+	if err := s.Listen("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Shutdown(context.Background())
+	addr := s.Listener.Addr().String()
+
+	a, err := NewClient("a", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewClient("b", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	a.Join("#chan")
+	b.Join("#chan")
+	a.Writer.Flush()
+	b.Writer.Flush()
+	readUntil(t, a, "JOIN #chan")
+
+	// b never reads, so its queue fills however big the socket buffers are.
+	done := make(chan bool)
+	go func() {
+		line := strings.Repeat("x", 400)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			fmt.Fprintf(a.Writer, "PRIVMSG #chan :%s\r\n", line)
+			a.Writer.Flush()
+		}
+	}()
+	readUntil(t, a, "QUIT :SendQ exceeded")
+	close(done)
+
+	// b's poller has let go of it, so a connection that reuses its fd is
+	// read as usual.
+	c, err := NewClient("c", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Join("#chan")
+	c.Writer.Flush()
+	readUntil(t, a, ":c!")
+	if n := s.NumClients(); n != 2 {
+		t.Errorf("expected 2 peers, got %d", n)
+	}
+}
@@ -1,8 +1,15 @@
 package irc_go_test
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	. "github.com/fatlotus/fast-irc-golang"
 )
@@ -13,22 +20,76 @@ func must(b *testing.B, err error) {
 	}
 }
 
+// A client that stops reading is disconnected once its send queue fills,
+// rather than holding up everyone who sends to it.
+func TestSlowReader(t *testing.T) {
+	s := NewServer()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.Background())
+
+	a, err := NewPipeClient("a", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewPipeClient("b", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	send(a, "JOIN #chan")
+	readUntil(t, a, "366 a #chan")
+	send(b, "JOIN #chan")
+	readUntil(t, b, "366 b #chan")
+	readUntil(t, a, "JOIN #chan")
+
+	for i := 0; i < 2*SendQueueLen; i++ {
+		fmt.Fprintf(a.Writer, "PRIVMSG #chan :%d\r\n", i)
+	}
+	a.Writer.Flush()
+	readUntil(t, a, "QUIT :SendQ exceeded")
+}
+
+// Attaches a peer over an in-memory pipe whose far end throws away whatever
+// it's sent, so that tests can drive the peer directly with Route.
+func attach(tb testing.TB, s *Server) *Peer {
+	client, server := net.Pipe()
+	go io.Copy(ioutil.Discard, client)
+	p, err := s.Attach(server)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return p
+}
+
+// Lets p's send queue catch up before it overflows, as a client's reading
+// would slow down a real sender.
+func keepUp(p *Peer) {
+	for p.Output.Len() >= SendQueueLen/2 {
+		runtime.Gosched()
+	}
+}
+
 func BenchmarkPrivmsgJustHandlingTheRequest(b *testing.B) {
 	s := NewServer()
-	client_a := s.AddPeer(nil)
-	client_b := s.AddPeer(nil)
+	client_a := attach(b, s)
+	client_b := attach(b, s)
 	must(b, s.SetNick(client_a, "a"))
 	must(b, s.SetNick(client_b, "b"))
 
 	for i := 0; i < b.N; i++ {
 		must(b, s.SendMessage("PRIVMSG", client_a, "b", "hi"))
+		keepUp(client_b)
 	}
 }
 
 func BenchmarkPrivmsgMessageDispatch(b *testing.B) {
+	b.ReportAllocs()
 	s := NewServer()
-	client_a := s.AddPeer(nil)
-	client_b := s.AddPeer(nil)
+	client_a := attach(b, s)
+	client_b := attach(b, s)
 
 	must(b, client_a.Route("USER", []string{"*", "*", "a"}, "a"))
 	must(b, client_a.Route("NICK", []string{"a"}, ""))
@@ -40,7 +101,41 @@ func BenchmarkPrivmsgMessageDispatch(b *testing.B) {
 	message := "hi"
 	for i := 0; i < b.N; i++ {
 		must(b, client_a.Route("PRIVMSG", args, message))
+		keepUp(client_b)
+	}
+}
+
+// Sends to many channels at once, one per goroutine, which should scale with
+// GOMAXPROCS (try -cpu 1,2,4,8) since unrelated channels don't share a lock.
+func BenchmarkPrivmsgParallel(b *testing.B) {
+	s := NewServer()
+	channels := 64
+	senders, receivers := []*Peer{}, []*Peer{}
+	for i := 0; i < channels; i++ {
+		name := fmt.Sprintf("#chan%d", i)
+		for _, nick := range []string{"a", "b"} {
+			p := attach(b, s)
+			must(b, p.Route("USER", []string{"*", "*", nick}, nick))
+			must(b, p.Route("NICK", []string{fmt.Sprintf("%s%d", nick, i)}, ""))
+			must(b, s.Join(p, name))
+			if nick == "a" {
+				senders = append(senders, p)
+			} else {
+				receivers = append(receivers, p)
+			}
+		}
 	}
+
+	next := int32(-1)
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddInt32(&next, 1)) % channels
+		sender, receiver := senders[i], receivers[i]
+		name := fmt.Sprintf("#chan%d", i)
+		for pb.Next() {
+			must(b, s.SendMessage("PRIVMSG", sender, name, "hi"))
+			keepUp(receiver)
+		}
+	})
 }
 
 func BenchmarkPrivmsgLocalSocket(b *testing.B) {
@@ -83,6 +178,7 @@ func BenchmarkPrivmsgLocalSocket(b *testing.B) {
 }
 
 func BenchmarkHighFanout(b *testing.B) {
+	b.ReportAllocs()
 	s := NewServer()
 
 	err := s.Listen("localhost:0")
@@ -125,3 +221,62 @@ func BenchmarkHighFanout(b *testing.B) {
 		receiver.Close()
 	}
 }
+
+// Measures the memory held by each idle, registered connection.
+func benchmarkConnectionMemory(b *testing.B, epoll bool) {
+	const conns = 1000
+	perConn, goroutines := 0.0, 0.0
+	for i := 0; i < b.N; i++ {
+		s := NewServer()
+		s.UseEpoll = epoll
+		if err := s.Listen("localhost:0"); err != nil {
+			b.Fatal(err)
+		}
+		go s.Serve()
+		addr := s.Listener.Addr().String()
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		idle := runtime.NumGoroutine()
+
+		clients := make([]net.Conn, conns)
+		for j := range clients {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			fmt.Fprintf(conn, "NICK u%d\r\nUSER u * * :u\r\n", j)
+			clients[j] = conn
+		}
+		for s.NumUsers() < conns {
+			time.Sleep(time.Millisecond)
+		}
+
+		// Send queues only hold a goroutine while they have something to
+		// write, so give the welcome a moment to go out.
+		time.Sleep(100 * time.Millisecond)
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		used := (after.HeapInuse + after.StackInuse) - (before.HeapInuse + before.StackInuse)
+		perConn += float64(used) / conns
+		goroutines += float64(runtime.NumGoroutine()-idle) / conns
+
+		b.StopTimer()
+		s.Shutdown(context.Background())
+		for _, conn := range clients {
+			conn.Close()
+		}
+		b.StartTimer()
+	}
+	b.ReportMetric(perConn/float64(b.N), "bytes/conn")
+	b.ReportMetric(goroutines/float64(b.N), "goroutines/conn")
+}
+
+func BenchmarkConnectionMemoryGoroutines(b *testing.B) {
+	benchmarkConnectionMemory(b, false)
+}
+
+func BenchmarkConnectionMemoryEpoll(b *testing.B) {
+	benchmarkConnectionMemory(b, true)
+}
@@ -2,21 +2,65 @@ package irc_go
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 func (p *Peer) Write(msg string) {
-	// allow tests to work
+	p.WriteBytes([]byte(msg))
+}
+
+// Queues an encoded line, which must not be modified afterwards.
+func (p *Peer) WriteBytes(msg []byte) {
+	p.enqueue(queuedLine{buf: msg})
+}
+
+// Queues a line shared with other peers, holding it until it's written.
+func (p *Peer) writeShared(sb *sharedBuf) {
+	if p.Conn == nil {
+		return
+	}
+	sb.retain()
+	p.enqueue(queuedLine{buf: sb.b, shared: sb})
+}
+
+func (p *Peer) enqueue(line queuedLine) {
+	// Services and users on other servers have no connection of their own.
 	if p.Conn == nil {
 		return
 	}
+	msg := line.buf
 	if p.Server.Trace != nil {
 		fmt.Fprintf(p.Server.Trace, "S -> %d  %s\n", p.Key, msg[:len(msg)-2])
 	}
 
-	p.Output.Write([]byte(msg))
+	m := p.Server.Metrics
+	if m != nil {
+		atomic.AddUint64(&m.BytesOut, uint64(len(msg)))
+	}
+	if p.Output.push(line) {
+		return
+	}
+	if line.shared != nil {
+		line.shared.release()
+	}
+	if m != nil {
+		atomic.AddUint64(&m.SendOverflows, 1)
+	}
+	p.overflow()
+}
+
+// Disconnects a peer that has stopped reading what it's sent. Its reader
+// sees the connection close and quits it, without anyone waiting on it.
+func (p *Peer) overflow() {
+	if atomic.CompareAndSwapUint32(&p.overflowed, 0, 1) {
+		p.Server.closeConn(p)
+	}
 }
 
 func (p *Peer) SayFrom(source, format string, args ...interface{}) {
@@ -24,7 +68,29 @@ func (p *Peer) SayFrom(source, format string, args ...interface{}) {
 }
 
 func (p *Peer) Say(format string, args ...interface{}) {
-	p.Write(fmt.Sprintf(":s "+format+"\r\n", args...))
+	p.Write(":" + p.Server.Name + fmt.Sprintf(" "+format+"\r\n", args...))
+}
+
+var wordPool = sync.Pool{
+	New: func() interface{} {
+		words := make([]string, 0, 16)
+		return &words
+	},
+}
+
+// Appends the space-separated words of head, skipping empty ones.
+func splitWords(words []string, head string) []string {
+	for head != "" {
+		i := strings.IndexByte(head, ' ')
+		if i < 0 {
+			return append(words, head)
+		}
+		if i > 0 {
+			words = append(words, head[:i])
+		}
+		head = head[i+1:]
+	}
+	return words
 }
 
 func (p *Peer) HandleLine(line []byte) (done bool) {
@@ -48,30 +114,50 @@ func (p *Peer) HandleLine(line []byte) (done bool) {
 		defer p.Server.TraceLock.Unlock()
 	}
 
+	if m := p.Server.Metrics; m != nil {
+		atomic.AddUint64(&m.BytesIn, uint64(len(line))+2)
+	}
+
+	if p.Neighbour != nil {
+		p.Server.HandleServerLine(p, strings.TrimSpace(string(line)))
+		return false
+	}
+
 	if len(line) >= 495 {
 		line = line[:495]
 	}
 
-	chunks := strings.SplitN(strings.TrimSpace(string(line)), ":", 2)
-	message := ""
-	if len(chunks) > 1 {
-		message = chunks[1]
+	// The one copy made of the line: commands keep their arguments as nicks,
+	// topics and history, so they can't point into the read buffer.
+	text := string(bytes.TrimSpace(line))
+	head, message := text, ""
+	if i := strings.IndexByte(text, ':'); i >= 0 {
+		head, message = text[:i], text[i+1:]
 	}
 
-	raw := strings.Split(chunks[0], " ")
-	words := make([]string, 0, len(raw))
-	for _, word := range raw {
-		if word != "" {
-			words = append(words, word)
+	// The words only live as long as the command, so their slice is reused.
+	wordsp := wordPool.Get().(*[]string)
+	words := splitWords((*wordsp)[:0], head)
+	defer func() {
+		for i := range words {
+			words[i] = ""
 		}
-	}
+		*wordsp = words[:0]
+		wordPool.Put(wordsp)
+	}()
 	if len(words) == 0 {
 		return false
 	}
+	if message == "" && len(head) < len(text) {
+		if c, ok := p.Server.Commands[words[0]]; ok && c.EmptyTrailing {
+			words = append(words, "")
+		}
+	}
 
 	if err := p.Route(words[0], words[1:], message); err != nil {
 		p.Say("%s", err.Error())
-		if _, ok := err.(*Quitting); ok {
+		switch err.(type) {
+		case *Quitting, *Banned, *LinkRejected:
 			return true
 		}
 	}
@@ -80,20 +166,67 @@ func (p *Peer) HandleLine(line []byte) (done bool) {
 }
 
 func (p *Peer) HandleInput() {
-	defer p.Conn.Close()
-	defer p.Output.Close()
-	defer p.Server.RemovePeer(p)
-
-	sc := bufio.NewScanner(p.Conn)
-	sc.Split(bufio.ScanLines)
-	for sc.Scan() {
-		if p.HandleLine(sc.Bytes()) {
-			return
+	defer p.Server.Handlers.Done()
+
+	// A peer accepted mid-handoff is passed along before it reads anything.
+	if p.Server.IsHandingOff() {
+		return
+	}
+
+	r := bufio.NewReader(io.MultiReader(bytes.NewReader(p.Pending), p.Conn))
+	p.Pending = nil
+
+	long := false
+	for {
+		line, err := r.ReadSlice('\n')
+		switch {
+		case err == bufio.ErrBufferFull:
+			// HandleLine truncates long lines anyway, so only the first
+			// chunk matters.
+			if !long && p.HandleLine(line) {
+				p.hangUp()
+				return
+			}
+			long = true
+			continue
+		case err == nil || err == io.EOF && len(line) > 0:
+			if !long && p.HandleLine(bytes.TrimRight(line, "\r\n")) {
+				p.hangUp()
+				return
+			}
+			long = false
+		}
+		if err == nil {
+			continue
 		}
+
+		p.endInput(err, line)
+		return
 	}
-	if sc.Err() != nil {
-		p.Server.Quit(p, sc.Err().Error())
+}
+
+// Disconnects a peer whose input has stopped, unless a handoff is underway,
+// in which case the unread input is kept for the next process.
+func (p *Peer) endInput(err error, pending []byte) {
+	if p.Server.IsHandingOff() {
+		p.Pending = append([]byte(nil), pending...)
+		return
+	}
+	if reason := p.Server.ShutdownReason(); reason != "" {
+		p.Say("ERROR :Closing Link: (%s)", reason)
+		p.Server.Quit(p, reason)
+	} else if atomic.LoadUint32(&p.overflowed) != 0 {
+		p.Server.Quit(p, "SendQ exceeded")
+	} else if err != io.EOF {
+		p.Server.Quit(p, err.Error())
 	} else {
 		p.Server.Quit(p, "dropped connection")
 	}
+	p.hangUp()
+}
+
+func (p *Peer) hangUp() {
+	p.Server.RemovePeer(p)
+	p.Output.Close()
+	p.Conn.Close()
 }
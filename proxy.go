@@ -0,0 +1,110 @@
+package irc_go
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a trusted proxy has to send its PROXY header.
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyHeader = errors.New("irc: invalid PROXY protocol header")
+
+// Whether a connection from addr must begin with a PROXY header.
+func (s *Server) expectsProxyHeader(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.ProxyProtocol && s.TrustedProxies.Contains(tcp.IP)
+}
+
+// Reads a version 1 or 2 PROXY protocol header from conn, returning the
+// address of the client it was sent on behalf of. Nothing past the header
+// is read, so the connection can still be polled or handed off. For health
+// checks and UNKNOWN connections, the proxy's own address is returned.
+func readProxyHeader(conn net.Conn) (net.Addr, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(conn, head[:5]); err != nil {
+		return nil, err
+	}
+	if string(head[:5]) == "PROXY" {
+		return readProxyV1(conn)
+	}
+	if _, err := io.ReadFull(conn, head[5:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(head[:12], proxySignature) || head[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, err
+	}
+
+	// A LOCAL command comes from the proxy itself.
+	if head[12]&0xf == 0 {
+		return conn.RemoteAddr(), nil
+	}
+	if head[12]&0xf != 1 {
+		return nil, errProxyHeader
+	}
+	switch head[13] >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, errProxyHeader
+		}
+		port := int(binary.BigEndian.Uint16(body[8:]))
+		return &net.TCPAddr{IP: net.IP(body[:4]), Port: port}, nil
+	case 2:
+		if len(body) < 36 {
+			return nil, errProxyHeader
+		}
+		port := int(binary.BigEndian.Uint16(body[32:]))
+		return &net.TCPAddr{IP: net.IP(body[:16]), Port: port}, nil
+	}
+	return conn.RemoteAddr(), nil
+}
+
+// Reads the rest of a human-readable header, such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 6667\r\n", a byte at a time so
+// as not to read past it.
+func readProxyV1(conn net.Conn) (net.Addr, error) {
+	line := []byte("PROXY")
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		// The longest valid header is 107 bytes.
+		if len(line) >= 107 {
+			return nil, errProxyHeader
+		}
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return conn.RemoteAddr(), nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
@@ -0,0 +1,84 @@
+package irc_go_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	. "github.com/fatlotus/fast-irc-golang"
+)
+
+func TestProxyProtocol(t *testing.T) {
+	s := NewServer()
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	s.TrustedProxies = CIDRList{loopback}
+	s.ProxyProtocol = true
+	s.Bans = []string{"*!*@192.0.2.66"}
+	if err := s.Listen("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Listener.Close()
+	addr := s.Listener.Addr().String()
+	go s.Serve()
+
+	connect := func(header []byte, nick string) *Client {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(header)
+		fmt.Fprintf(conn, "NICK %s\r\nUSER %s * * :%s\r\n", nick, nick, nick)
+		return &Client{Conn: conn, Reader: bufio.NewReader(conn)}
+	}
+
+	// A proxy that's slow to send its header holds up nobody else.
+	slow, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	slow.Write([]byte("PROXY TCP4"))
+
+	a := connect([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 6667\r\n"), "a")
+	defer a.Close()
+	readUntil(t, a, "422")
+
+	v2 := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x21, 0, 36)
+	v2 = append(v2, net.ParseIP("2001:db8::7")...)
+	v2 = append(v2, net.ParseIP("2001:db8::1")...)
+	v2 = binary.BigEndian.AppendUint16(v2, 56324)
+	v2 = binary.BigEndian.AppendUint16(v2, 6667)
+	b := connect(v2, "b")
+	defer b.Close()
+	readUntil(t, b, "422")
+
+	// LOCAL connections, such as health checks, keep the proxy's address.
+	c := connect(append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20, 0, 0, 0), "c")
+	defer c.Close()
+	readUntil(t, c, "422")
+
+	hosts := map[string]string{}
+	s.RLock()
+	for _, p := range s.Peers {
+		hosts[p.Nick] = p.Host
+	}
+	s.RUnlock()
+	if hosts["a"] != "192.0.2.1" || hosts["b"] != "2001:db8::7" || hosts["c"] != "127.0.0.1" {
+		t.Errorf("unexpected hosts %v", hosts)
+	}
+
+	// Bans apply to the client's own address.
+	banned := connect([]byte("PROXY TCP4 192.0.2.66 198.51.100.1 56324 6667\r\n"), "d")
+	defer banned.Close()
+	readUntil(t, banned, "You are banned")
+
+	// Without a valid header, the connection is dropped.
+	bad := connect([]byte("NICK e\r\n"), "e")
+	defer bad.Close()
+	if line, err := bad.Reader.ReadString('\n'); err == nil {
+		t.Errorf("expected the connection to be closed, got %q", strings.TrimSpace(line))
+	}
+}
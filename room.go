@@ -1,37 +1,118 @@
 package irc_go
 
 import (
-	"fmt"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Channel privilege modes from highest to lowest, and the prefix shown for
+// each in NAMES and WHO, as advertised in PREFIX.
+const (
+	PrefixModes   = "qaohv"
+	PrefixSymbols = "~&@%+"
+)
+
+// Privilege ranks, in the same order as PrefixModes.
+const (
+	RankNone = iota
+	RankVoice
+	RankHalfOp
+	RankOp
+	RankAdmin
+	RankOwner
+)
+
+// The set of privilege modes a member holds in a room, with one bit per rank.
+type Privileges uint8
+
+const (
+	PrivVoice Privileges = 1 << iota
+	PrivHalfOp
+	PrivOp
+	PrivAdmin
+	PrivOwner
+)
+
+// Returns the bit for a privilege mode character, or 0 if it isn't one.
+func PrivilegeFor(mode byte) Privileges {
+	i := strings.IndexByte(PrefixModes, mode)
+	if i < 0 {
+		return 0
+	}
+	return PrivOwner >> uint(i)
+}
+
+// A peer's membership in a room, which is dropped along with everything
+// granted to them when they leave.
+type Member struct {
+	*Peer
+	Privileges Privileges
+	Joined     time.Time
+}
+
+// The Members map belongs to the server lock; everything else, including
+// each member's privileges, to the room's own lock.
 type Room struct {
-	Members  map[int]*Peer
-	Speakers []*Peer
-	Topic    string
+	Members map[int]*Member
+	Created time.Time
+	Bans    []string
+
+	// The topic, and the hostmask (or server name) of whoever set it when.
+	Topic       string
+	TopicSetter string
+	TopicTime   time.Time
 
 	IsModerated  bool
 	IsFixedTopic bool
+	IsSecret     bool
+	IsPrivate    bool
+	// Cleared by +n, which is the default; -n lets non-members send to the
+	// room.
+	AllowsExternal bool
+
+	sync.RWMutex
+}
+
+// Whether the room is left out of LIST, NAMES and WHOIS for p, as secret and
+// private rooms are for non-members. Must be called with the server and room
+// at least read-locked.
+func (r *Room) IsHiddenFrom(p *Peer) bool {
+	return (r.IsSecret || r.IsPrivate) && !r.ContainsMember(p)
+}
+
+// The channel type shown in NAMES replies. Must be called with the room at
+// least read-locked.
+func (r *Room) NamesSymbol() string {
+	switch {
+	case r.IsSecret:
+		return "@"
+	case r.IsPrivate:
+		return "*"
+	}
+	return "="
 }
 
 func (r *Room) SendMessage(cmd string, sender *Peer, nick, message string) error {
-	msg := fmt.Sprintf(":%s!%s@c %s %s :%s\r\n", sender.Nick, sender.User, cmd, nick, message)
+	line := NewRelay().Line(sender.Nick+"!"+sender.User+"@c", "%s %s :%s", cmd, nick, message)
+	defer line.Release()
 	for _, member := range r.Members {
-		member.Write(msg)
+		line.SendTo(member.Peer)
 	}
 	return nil
 }
 
 func (r *Room) ContainsMember(peer *Peer) bool {
-	for _, member := range r.Members {
-		if member == peer {
-			return true
-		}
-	}
-	return false
+	member, ok := r.Members[peer.Key]
+	return ok && member.Peer == peer
 }
 
-func (r *Room) AddMember(peer *Peer) {
-	r.Members[peer.Key] = peer
+func (r *Room) AddMember(peer *Peer, privileges Privileges) {
+	r.Members[peer.Key] = &Member{
+		Peer:       peer,
+		Privileges: privileges,
+		Joined:     time.Now(),
+	}
 }
 
 func (r *Room) RemoveMember(s *Server, name string, peer *Peer) {
@@ -41,3 +122,84 @@ func (r *Room) RemoveMember(s *Server, name string, peer *Peer) {
 		delete(s.Rooms, name)
 	}
 }
+
+// Grants or revokes a privilege, returning false if the peer isn't in the
+// room.
+func (r *Room) SetPrivilege(peer *Peer, privilege Privileges, enable bool) bool {
+	member, ok := r.Members[peer.Key]
+	if !ok {
+		return false
+	}
+	if enable {
+		member.Privileges |= privilege
+	} else {
+		member.Privileges &^= privilege
+	}
+	return true
+}
+
+// Lists the privilege modes the peer holds in the room, highest first.
+func (r *Room) Modes(peer *Peer) string {
+	member, ok := r.Members[peer.Key]
+	if !ok {
+		return ""
+	}
+	modes := ""
+	for i := range PrefixModes {
+		if member.Privileges&(PrivOwner>>uint(i)) != 0 {
+			modes += PrefixModes[i : i+1]
+		}
+	}
+	return modes
+}
+
+// The highest privilege the peer holds in the room. IRC operators outrank
+// everyone.
+func (r *Room) Rank(peer *Peer) int {
+	if peer.IsGlobalOperator {
+		return RankOwner
+	}
+	member, ok := r.Members[peer.Key]
+	if !ok {
+		return RankNone
+	}
+	rank := RankNone
+	for p := member.Privileges; p != 0; p >>= 1 {
+		rank++
+	}
+	return rank
+}
+
+func (r *Room) IsBanned(peer *Peer) bool {
+	for _, ban := range r.Bans {
+		if peer.MatchesMask(ban) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Room) SetBan(mask string, enable bool) {
+	for i, ban := range r.Bans {
+		if ban == mask {
+			r.Bans = append(r.Bans[:i], r.Bans[i+1:]...)
+			break
+		}
+	}
+	if enable {
+		r.Bans = append(r.Bans, mask)
+	}
+}
+
+// Turns privilege modes into NAMES prefixes: all of them with multi-prefix,
+// otherwise just the highest.
+func ModePrefixes(modes string, multi bool) string {
+	if !multi && len(modes) > 1 {
+		modes = modes[:1]
+	}
+	prefixes := make([]byte, len(modes))
+	for i := range modes {
+		prefixes[i] = PrefixSymbols[strings.IndexByte(PrefixModes, modes[i])]
+	}
+	return string(prefixes)
+}
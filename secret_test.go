@@ -0,0 +1,80 @@
+package irc_go_test
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/fatlotus/fast-irc-golang"
+)
+
+func TestSecretChannels(t *testing.T) {
+	s := NewServer()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewPipeClient("a", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewPipeClient("b", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	send(a, "JOIN #secret")
+	readUntil(t, a, "366 a #secret")
+	send(a, "MODE #secret +s")
+	readUntil(t, a, "MODE #secret +s")
+	send(a, "JOIN #private")
+	readUntil(t, a, "366 a #private")
+	send(a, "MODE #private +p")
+	readUntil(t, a, "MODE #private +p")
+	send(a, "JOIN #public")
+	readUntil(t, a, "366 a #public")
+
+	// Members see the rooms, and what kind they are.
+	send(a, "NAMES #secret")
+	readUntil(t, a, "353 a @ #secret :@a")
+	send(a, "NAMES #private")
+	readUntil(t, a, "353 a * #private :@a")
+	send(a, "MODE #secret")
+	readUntil(t, a, "324 a #secret +ns")
+
+	// Others see only the public one.
+	send(b, "LIST")
+	readUntilWithout(t, b, "322 b #public", "#secret")
+	readUntilWithout(t, b, "323 b", "#private")
+	send(b, "WHOIS a")
+	if line := readUntil(t, b, "319 b"); line != ":s 319 b 1 :@#public \r\n" {
+		t.Errorf("unexpected WHOIS channels %q", line)
+	}
+	send(b, "NAMES #secret")
+	readUntilWithout(t, b, "366 b #secret", "353")
+	send(b, "WHO #private")
+	readUntilWithout(t, b, "315 b #private", "352")
+
+	// With -n, non-members may send to a room.
+	send(b, "PRIVMSG #public :hi")
+	readUntil(t, b, "404 b #public")
+	send(a, "MODE #public -n")
+	readUntil(t, a, "MODE #public -n")
+	send(b, "PRIVMSG #public :hi")
+	readUntil(t, a, "PRIVMSG #public :hi")
+	send(a, "MODE #public +n")
+	readUntil(t, a, "MODE #public +n")
+	send(b, "PRIVMSG #public :hi")
+	readUntil(t, b, "404 b #public")
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Stop(context.Background())
+	}()
+	readUntil(t, a, "ERROR")
+	readUntil(t, b, "ERROR")
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+}
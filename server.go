@@ -1,20 +1,45 @@
 package irc_go
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
-
-	"github.com/fatlotus/batchwriter"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
+// Locking: the server lock guards the Peers, Nicks and Rooms maps, who is in
+// which room, and every peer's nick, account and away status. Each Room's
+// lock guards what is in the room: its topic, modes, bans and members'
+// privileges. Each Peer's lock guards its negotiated capabilities.
+//
+// Locks are always taken in that order: server, then room, then peer. A
+// command confined to one channel holds the server lock for reading and the
+// room lock as needed, so that channels proceed in parallel; anything that
+// changes membership or touches several rooms holds the server lock for
+// writing, which excludes every room lock holder too. Saving a registered
+// channel takes registryLock as well, since rooms save in parallel.
+//
+// Nothing waits on a peer's output while holding these locks: a peer whose
+// send queue fills up is disconnected rather than waited for.
 type Server struct {
+	// Peers holds local connections, including links to other servers;
+	// Nicks holds every user on the network.
 	Peers map[int]*Peer
 	Nicks map[string]*Peer
 
 	Rooms map[string]*Room
 
+	// Every other server on the network, by name.
+	Servers map[string]*RemoteServer
+
 	UserCount   int
 	NextPeerKey int
 
@@ -25,54 +50,227 @@ type Server struct {
 	Trace     io.Writer
 	LastMotd  string
 
+	Name                string
 	Password            string
 	MessageOfTheDayPath string
 
-	Listener net.Listener
+	ConfigPath string
+	Opers      map[string]string
+	LocalOpers map[string]string
+	Links      map[string]LinkConfig
+	Limits     Limits
+	Bans       []string
+
+	ChannelStore ChannelStore
+	Registered   map[string]*ChannelRecord
+	registryLock sync.Mutex
+
+	// Pseudo-users that handle PRIVMSGs sent to them, keyed by lowercase
+	// nick.
+	Services map[string]Service
+	NickServ *NickServ
+	ChanServ *ChanServ
+
+	// When set, PRIVMSGs and NOTICEs are recorded for CHATHISTORY.
+	History     *History
+	NextBatchID uint64
+
+	Listener  net.Listener
+	Listeners []net.Listener
+
+	// Set once Shutdown has been called, to the reason given to peers.
+	Closing string
+	// Tracks the HandleInput goroutine of every connected peer.
+	Handlers sync.WaitGroup
+	// Called for the DIE and RESTART commands; when nil, the server simply
+	// shuts itself down.
+	OnTerminate func(restart bool)
+	// Non-nil while HandOff is passing connections to a new process.
+	Handover *Handover
+
+	// When set, peers are read by a few epoll-driven pollers with shared
+	// buffers rather than a goroutine each. Only supported on Linux;
+	// elsewhere it has no effect.
+	UseEpoll bool
+	pollers  []*poller
+	pollLock sync.Mutex
+
+	// Counts the accept loops begun by Start, which Stop waits for.
+	serving sync.WaitGroup
+
+	// The commands peers may send, by name, and the plugins added with
+	// AddPlugin.
+	Commands map[string]*Command
+	plugins  []interface{}
+
+	// Proxies trusted to report the real address of the clients they
+	// forward, and whether those connecting to our listeners begin with a
+	// PROXY protocol header to do so.
+	TrustedProxies CIDRList
+	ProxyProtocol  bool
+
+	// Addresses exempt from the per-address connection limits, and the
+	// recent and open connections from the rest, by address.
+	ConnectExempt CIDRList
+	throttle      map[string]*connectRate
+	perIP         map[string]int
+
+	// Traffic counters for the admin endpoint; nil unless EnableMetrics
+	// was called.
+	Metrics *Metrics
+	// When set, the admin endpoint requires it as a bearer token.
+	AdminToken string
+
+	sync.RWMutex
+}
+
+var ErrServerClosed = errors.New("irc: Server closed")
+var ErrServerFull = errors.New("irc: Server is full")
+var ErrConnectionRefused = errors.New("irc: Connection refused by a plugin")
+
+// How many lines may wait to be sent to a peer before it is disconnected for
+// not reading them.
+const SendQueueLen = 1024
+
+// The longest topic kept, in bytes, unless Limits.TopicLen says otherwise.
+const DefaultTopicLen = 390
 
-	sync.Mutex
+// Tracks an in-progress zero-downtime restart. Done is closed once the state
+// has been passed along (or the attempt abandoned), after which Succeeded
+// reports which.
+type Handover struct {
+	Done      chan bool
+	Succeeded bool
 }
 
+type deadliner interface {
+	SetDeadline(time.Time) error
+}
+
+// Whether the peer is an operator (or better) in the named room. Must be
+// called with the server locked.
 func IsModerator(peer *Peer, room string) bool {
 	if peer.IsGlobalOperator {
 		return true
 	}
-	for _, r := range peer.IsModOf {
-		if r == room {
-			return true
-		}
-	}
-	return false
+	r, ok := peer.Server.Rooms[room]
+	return ok && r.Rank(peer) >= RankOp
 }
 
+// Adds a peer for n without reading from it; see Attach. A nil n makes a
+// peer that discards all of its output, which is only useful in benchmarks.
 func (s *Server) AddPeer(n net.Conn) *Peer {
 	s.Lock()
 	defer s.Unlock()
+	if n == nil {
+		return s.addPeer(nil, "")
+	}
+	return s.addPeer(n, hostOf(n.RemoteAddr()))
+}
+
+func (s *Server) addPeer(n net.Conn, host string) *Peer {
 	p := &Peer{
 		Conn:   n,
 		Key:    s.NextPeerKey,
 		Server: s,
-		Output: batchwriter.New(n),
+		Output: NewSendQueue(n, SendQueueLen),
+		Host:   host,
+		Addr:   host,
+	}
+	if n != nil {
+		s.Handlers.Add(1)
 	}
 	s.Peers[s.NextPeerKey] = p
 	s.NextPeerKey += 1
+	s.countAddr(p.Addr, 1)
 	return p
 }
 
-func (s *Server) RegisteredUser(p *Peer) {
+func hostOf(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+func (s *Server) RegisteredUser(p *Peer) error {
 	s.Lock()
 	defer s.Unlock()
 
+	for _, ban := range s.Bans {
+		if p.MatchesMask(ban) {
+			return &Banned{}
+		}
+	}
+
 	s.UserCount += 1
+	s.introduce(nil, p)
+	return nil
 }
 
-func (s *Server) Quit(p *Peer, message string) error {
+func (s *Server) CheckOperator(name, password string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.Password != "" && s.Password == password {
+		return true
+	}
+	expected, ok := s.Opers[name]
+	return ok && expected == password
+}
+
+// Makes p an IRC operator if the credentials are valid: a network-wide one
+// (+o) for Opers, or one for this server alone (+O) for LocalOpers.
+func (s *Server) Oper(p *Peer, name, password string) bool {
+	global := s.CheckOperator(name, password)
 	s.Lock()
 	defer s.Unlock()
 
+	if !global {
+		expected, ok := s.LocalOpers[name]
+		if !ok || expected != password {
+			return false
+		}
+		p.UserModes |= ModeLocalOperator
+		return true
+	}
+	p.IsGlobalOperator = true
+	s.propagate(p, p.Nick, "MODE %s :+o", p.Nick)
+	return true
+}
+
+func (s *Server) IsFull() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.Limits.MaxClients > 0 && len(s.Peers) >= s.Limits.MaxClients
+}
+
+func (s *Server) Quit(p *Peer, message string) error {
+	s.Lock()
+	local := p.SentWelcome && p.Neighbour == nil
+	err := s.quit(p, message)
+	s.Unlock()
+
+	if local {
+		s.quitted(p, err.(*Quitting).Reason)
+	}
+	return err
+}
+
+func (s *Server) quit(p *Peer, message string) error {
 	if message == "" {
 		message = "Client Quit"
 	}
+	if p.Neighbour != nil {
+		s.split(p.Neighbour, message)
+		p.Neighbour = nil
+		return &Quitting{message}
+	}
+	// Users already removed, such as by a netsplit, aren't announced again.
+	if p.SentWelcome && s.Nicks[p.Nick] == p {
+		s.propagate(p, p.Nick, "QUIT :%s", message)
+	}
 	// fixme: remove copy
 	toremove := map[string]*Room{}
 	for name, room := range s.Rooms {
@@ -80,10 +278,12 @@ func (s *Server) Quit(p *Peer, message string) error {
 			toremove[name] = room
 		}
 	}
+	line := NewRelay().Line(p.Nick+"!u@h", "QUIT :%s", message)
+	defer line.Release()
 	for name, room := range toremove {
 		for _, member := range room.Members {
-			if member != p {
-				member.SayFrom(p.Nick+"!u@h", "QUIT :%s", message)
+			if member.Peer != p {
+				line.SendTo(member.Peer)
 			}
 		}
 		room.RemoveMember(s, name, p)
@@ -95,7 +295,11 @@ func (s *Server) Quit(p *Peer, message string) error {
 func (s *Server) RemovePeer(p *Peer) {
 	s.Lock()
 	defer s.Unlock()
+	if s.Peers[p.Key] != p {
+		return
+	}
 	delete(s.Peers, p.Key)
+	s.countAddr(p.Addr, -1)
 	if p.Nick != "" {
 		delete(s.Nicks, p.Nick)
 	}
@@ -109,36 +313,166 @@ func (s *Server) SetAway(p *Peer, away string) error {
 	defer s.Unlock()
 
 	p.Away = away
+
+	var line *Line
+	if away != "" {
+		line = NewRelay().Line(p.Nick+"!u@h", "AWAY :%s", away)
+		s.propagate(p, p.Nick, "AWAY :%s", away)
+	} else {
+		line = NewRelay().Line(p.Nick+"!u@h", "AWAY")
+		s.propagate(p, p.Nick, "AWAY")
+	}
+	defer line.Release()
+	for _, member := range s.neighbours(p) {
+		if member.HasCap("away-notify") {
+			line.SendTo(member)
+		}
+	}
+	return nil
+}
+
+// Collects everyone who shares a channel with p, not including p itself.
+// Must be called with the server locked.
+func (s *Server) neighbours(p *Peer) map[int]*Peer {
+	result := map[int]*Peer{}
+	for _, room := range s.Rooms {
+		if room.ContainsMember(p) {
+			for key, member := range room.Members {
+				if member.Peer != p {
+					result[key] = member.Peer
+				}
+			}
+		}
+	}
+	return result
+}
+
+// Tells account-notify clients that p has logged in or out. Must be called
+// with the server locked.
+func (s *Server) notifyAccount(p *Peer) {
+	account := p.Account
+	if account == "" {
+		account = "*"
+	}
+	line := NewRelay().Line(p.Nick+"!u@h", "ACCOUNT %s", account)
+	defer line.Release()
+	for _, member := range s.neighbours(p) {
+		if member.HasCap("account-notify") {
+			line.SendTo(member)
+		}
+	}
+}
+
+// Changes the user and host shown for nick, telling chghost clients. Others
+// see the user quit and rejoin their shared rooms under the new hostmask.
+// The address the user connected from is left alone.
+func (s *Server) ChangeHost(sender *Peer, nick, user, host string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	p, ok := s.Nicks[nick]
+	if !ok || p.Key < 0 {
+		return &NoSuchUser{sender.Nick, nick}
+	}
+
+	old := p.Hostmask()
+	p.User = user
+	p.Host = host
+
+	relay := NewRelay()
+	line := relay.Line(old, "CHGHOST %s %s", user, host)
+	defer line.Release()
+	quit := relay.Line(old, "QUIT :Changing host")
+	defer quit.Release()
+	quitted := map[*Peer]bool{}
+	for name, room := range s.Rooms {
+		if !room.ContainsMember(p) {
+			continue
+		}
+		room.RLock()
+		join := relay.Line(p.Hostmask(), "JOIN %s", name)
+		var mode *Line
+		if modes := room.Modes(p); modes != "" {
+			mode = relay.Line(s.Name, "MODE %s +%s%s", name, modes,
+				strings.Repeat(" "+p.Nick, len(modes)))
+		}
+		for _, member := range room.Members {
+			if member.Peer == p || member.HasCap("chghost") {
+				continue
+			}
+			if !quitted[member.Peer] {
+				quit.SendTo(member.Peer)
+				quitted[member.Peer] = true
+			}
+			join.SendTo(member.Peer)
+			if mode != nil {
+				mode.SendTo(member.Peer)
+			}
+		}
+		room.RUnlock()
+		join.Release()
+		if mode != nil {
+			mode.Release()
+		}
+	}
+	for _, member := range s.neighbours(p) {
+		if member.HasCap("chghost") {
+			line.SendTo(member)
+		}
+	}
+	if p.HasCap("chghost") {
+		line.SendTo(p)
+	}
 	return nil
 }
 
 func (s *Server) SetNick(p *Peer, nick string) error {
 	s.Lock()
 	defer s.Unlock()
+
+	return s.setNick(p, nick)
+}
+
+func (s *Server) setNick(p *Peer, nick string) error {
+	if s.Limits.NickLen > 0 && len(nick) > s.Limits.NickLen && p.Origin == nil {
+		return &ErroneousNickname{p.NickOrAsterix(), nick}
+	}
 	if s.Nicks[nick] != nil {
 		return &NickAlreadyInUse{nick}
 	}
+	if _, ok := s.Services[strings.ToLower(nick)]; ok && p.Origin == nil {
+		return &NickAlreadyInUse{nick}
+	}
 
+	line := NewRelay().Line(p.Nick+"!u@h", "NICK :%s", nick)
+	defer line.Release()
 	for _, room := range s.Rooms {
 		if room.ContainsMember(p) {
 			for _, member := range room.Members {
-				member.SayFrom(p.Nick+"!u@h", "NICK :%s", nick)
+				line.SendTo(member.Peer)
 			}
 		}
 	}
 
+	if p.SentWelcome {
+		s.propagate(p, p.Nick, "NICK %s", nick)
+	}
 	if p.Nick != "" {
 		delete(s.Nicks, p.Nick)
 	}
 	p.Nick = nick
 	s.Nicks[p.Nick] = p
 
+	if s.NickServ != nil && p.Origin == nil {
+		s.NickServ.checkNick(p)
+	}
+
 	return nil
 }
 
 func (s *Server) Whois(sender *Peer, nick string) error {
-	s.Lock()
-	defer s.Unlock()
+	s.RLock()
+	defer s.RUnlock()
 
 	subject, ok := s.Nicks[nick]
 	if !ok {
@@ -150,24 +484,12 @@ func (s *Server) Whois(sender *Peer, nick string) error {
 	channels := ""
 	for channel, room := range s.Rooms {
 		if room.ContainsMember(subject) {
-			ismod := false
-			isvoice := false
-			for _, modroom := range subject.IsModOf {
-				if modroom == channel {
-					ismod = true
-				}
-			}
-			for _, speaker := range room.Speakers {
-				if speaker == subject {
-					isvoice = true
-				}
-			}
-			if ismod {
-				channels += "@" + channel + " "
-			} else if isvoice {
-				channels += "+" + channel + " "
-			} else {
-				channels += channel + " "
+			room.RLock()
+			hidden := room.IsHiddenFrom(sender)
+			modes := room.Modes(subject)
+			room.RUnlock()
+			if !hidden {
+				channels += ModePrefixes(modes, sender.HasCap("multi-prefix")) + channel + " "
 			}
 		}
 	}
@@ -183,6 +505,12 @@ func (s *Server) Whois(sender *Peer, nick string) error {
 	if subject.IsGlobalOperator {
 		sender.Say("313 %s %s :is an IRC operator", sender.Nick, nick)
 	}
+	if subject.Account != "" {
+		sender.Say("330 %s %s %s :is logged in as", sender.Nick, nick, subject.Account)
+	}
+	if subject.UserModes&ModeBot != 0 {
+		sender.Say("335 %s %s :is a bot", sender.Nick, nick)
+	}
 
 	sender.Say("318 %s 1 :End of WHOIS list", sender.Nick)
 
@@ -190,8 +518,8 @@ func (s *Server) Whois(sender *Peer, nick string) error {
 }
 
 func (s *Server) SetTopic(sender *Peer, channel, topic string) error {
-	s.Lock()
-	defer s.Unlock()
+	s.RLock()
+	defer s.RUnlock()
 
 	room, exists := s.Rooms[channel]
 	if !exists {
@@ -202,21 +530,37 @@ func (s *Server) SetTopic(sender *Peer, channel, topic string) error {
 		return &NotOnChannel{sender.Nick, channel}
 	}
 
-	if !IsModerator(sender, channel) && room.IsFixedTopic {
+	room.Lock()
+	defer room.Unlock()
+
+	if room.Rank(sender) < RankHalfOp && room.IsFixedTopic {
 		return &NotOperator{sender.Nick, channel}
 	}
 
+	// Topics from other servers were already cut to their own limit.
+	if n := s.topicLen(); len(topic) > n && sender.Origin == nil {
+		for n > 0 && !utf8.RuneStart(topic[n]) {
+			n--
+		}
+		topic = topic[:n]
+	}
 	room.Topic = topic
+	room.TopicSetter = sender.Hostmask()
+	room.TopicTime = time.Now()
+	s.saveRoom(channel, room)
+	s.propagate(sender, sender.Nick, "TOPIC %s :%s", channel, topic)
+	line := NewRelay().Line(sender.Nick+"!u@h", "TOPIC %s :%s", channel, topic)
+	defer line.Release()
 	for _, member := range room.Members {
-		member.SayFrom(sender.Nick+"!u@h", "TOPIC %s :%s", channel, topic)
+		line.SendTo(member.Peer)
 	}
 
 	return nil
 }
 
 func (s *Server) GetTopic(sender *Peer, channel string) (string, error) {
-	s.Lock()
-	defer s.Unlock()
+	s.RLock()
+	defer s.RUnlock()
 
 	room, exists := s.Rooms[channel]
 	if !exists {
@@ -227,9 +571,50 @@ func (s *Server) GetTopic(sender *Peer, channel string) (string, error) {
 		return "", &NotOnChannel{sender.Nick, channel}
 	}
 
+	room.RLock()
+	defer room.RUnlock()
 	return room.Topic, nil
 }
 
+// Answers a TOPIC query with the topic and who set it, or 331 if there's
+// none.
+func (s *Server) SendTopic(sender *Peer, channel string) error {
+	s.RLock()
+	defer s.RUnlock()
+
+	room, exists := s.Rooms[channel]
+	if !exists || !room.ContainsMember(sender) {
+		return &NotOnChannel{sender.Nick, channel}
+	}
+
+	room.RLock()
+	defer room.RUnlock()
+	if room.Topic == "" {
+		sender.Say("331 %s %s :No topic is set", sender.Nick, channel)
+	} else {
+		s.sendTopic(sender, channel, room)
+	}
+	return nil
+}
+
+// Sends 332 and, if who set the topic is known, 333. Must be called with
+// the room at least read-locked.
+func (s *Server) sendTopic(sender *Peer, channel string, room *Room) {
+	sender.Say("332 %s %s :%s", sender.Nick, channel, room.Topic)
+	if room.TopicSetter != "" {
+		sender.Say("333 %s %s %s %d", sender.Nick, channel, room.TopicSetter,
+			room.TopicTime.Unix())
+	}
+}
+
+// Must be called with the server at least read-locked.
+func (s *Server) topicLen() int {
+	if s.Limits.TopicLen > 0 {
+		return s.Limits.TopicLen
+	}
+	return DefaultTopicLen
+}
+
 func (s *Server) Part(sender *Peer, name, message string) error {
 	s.Lock()
 	defer s.Unlock()
@@ -239,119 +624,107 @@ func (s *Server) Part(sender *Peer, name, message string) error {
 		return &NoSuchChannel{sender.Nick, name}
 	}
 
-	if message == "" {
-		for _, member := range room.Members {
-			member.SayFrom(sender.Nick+"!u@h", "PART %s", name)
-		}
+	var line *Line
+	if message != "" {
+		line = NewRelay().Line(sender.Nick+"!u@h", "PART %s :%s", name, message)
 	} else {
-		for _, member := range room.Members {
-			member.SayFrom(sender.Nick+"!u@h", "PART %s :%s", name, message)
-		}
+		line = NewRelay().Line(sender.Nick+"!u@h", "PART %s", name)
+	}
+	defer line.Release()
+	for _, member := range room.Members {
+		line.SendTo(member.Peer)
 	}
 
 	if !room.ContainsMember(sender) {
 		return &NotOnChannel{sender.Nick, name}
 	}
 	room.RemoveMember(s, name, sender)
+	if message != "" {
+		s.propagate(sender, sender.Nick, "PART %s :%s", name, message)
+	} else {
+		s.propagate(sender, sender.Nick, "PART %s", name)
+	}
 	return nil
 }
 
 func (s *Server) SendAllNames(sender *Peer) error {
-	s.Lock()
-	defer s.Unlock()
+	s.RLock()
+	defer s.RUnlock()
 
 	leftover := map[int]bool{}
-	for key := range s.Peers {
-		leftover[key] = true
+	for key, p := range s.Peers {
+		if p.Neighbour == nil {
+			leftover[key] = true
+		}
 	}
 
+	// Members of hidden rooms are left over, unless they're in another.
 	for name, room := range s.Rooms {
 		s.sendNames(sender, name, room, &leftover)
 	}
 	if len(leftover) != 0 {
 		users := ""
 		for key := range leftover {
-			users += " " + s.Peers[key].Nick
+			if p := s.Peers[key]; !p.IsInvisible() || p == sender {
+				users += " " + p.Nick
+			}
+		}
+		if users != "" {
+			sender.Say("353 %s * * :%s", sender.Nick, users[1:])
 		}
-		sender.Say("353 %s * * :%s", sender.Nick, users[1:])
 	}
 	sender.Say("366 %s * 3", sender.Nick)
 	return nil
 }
 
+// Must be called with the server locked, but not the room.
 func (s *Server) sendNames(sender *Peer, name string, room *Room, leftover *map[int]bool) {
+	room.RLock()
+	defer room.RUnlock()
+
+	if room.IsHiddenFrom(sender) {
+		return
+	}
+
+	// Invisible members are only shown to those in the channel with them.
+	inside := room.ContainsMember(sender)
 	members := ""
 	for _, member := range room.Members {
 		if leftover != nil {
 			delete(*leftover, member.Key)
 		}
-
-		mod := false
-		for _, room := range member.IsModOf {
-			if room == name {
-				mod = true
-			}
-		}
-		voice := false
-		for _, speaker := range room.Speakers {
-			if speaker == member {
-				voice = true
-			}
-		}
-		if mod {
-			members += " @" + member.Nick
-		} else if voice {
-			members += " +" + member.Nick
-		} else {
-			members += " " + member.Nick
+		if member.IsInvisible() && !inside {
+			continue
 		}
-	}
-	sender.Say("353 %s = %s :%s", sender.Nick, name, members[1:])
-}
-
-func (s *Server) ListChannels(sender *Peer, channel string) error {
-	return nil
-}
-
-func (s *Server) ListAllChannels(sender *Peer) error {
-	s.Lock()
-	defer s.Unlock()
 
-	for name, room := range s.Rooms {
-		if room.Topic != "" {
-			sender.Say("322 %s %s %d :%s", sender.Nick, name, len(room.Members), room.Topic)
+		members += " " + ModePrefixes(room.Modes(member.Peer), sender.HasCap("multi-prefix"))
+		if sender.HasCap("userhost-in-names") {
+			members += member.Hostmask()
 		} else {
-			sender.Say("322 %s %s %d :No topic set", sender.Nick, name, len(room.Members))
+			members += member.Nick
 		}
 	}
-	sender.Say("323 %s :End of LIST", sender.Nick)
-
-	return nil
+	if members != "" {
+		sender.Say("353 %s %s %s :%s", sender.Nick, room.NamesSymbol(), name, members[1:])
+	}
 }
 
 func (s *Server) Who(sender *Peer, channel string) error {
-	s.Lock()
-	defer s.Unlock()
+	s.RLock()
+	defer s.RUnlock()
 
 	room, exists := s.Rooms[channel]
 	if !exists {
 		return &NoSuchUser{sender.Nick, channel}
 	}
 
+	room.RLock()
+	defer room.RUnlock()
+	inside := room.ContainsMember(sender)
 	for _, member := range room.Members {
-		mod := false
-		for _, room := range member.IsModOf {
-			if room == channel {
-				mod = true
-			}
+		if !inside && (member.IsInvisible() || room.IsSecret || room.IsPrivate) {
+			continue
 		}
-		voice := false
-		for _, speaker := range room.Speakers {
-			if speaker == member {
-				voice = true
-			}
-		}
-
 		flags := ""
 		if member.Away == "" {
 			flags += "H"
@@ -361,11 +734,10 @@ func (s *Server) Who(sender *Peer, channel string) error {
 		if member.IsGlobalOperator {
 			flags += "*"
 		}
-		if mod {
-			flags += "@"
-		} else if voice {
-			flags += "+"
+		if member.UserModes&ModeBot != 0 {
+			flags += "B"
 		}
+		flags += ModePrefixes(room.Modes(member.Peer), sender.HasCap("multi-prefix"))
 
 		sender.Say(
 			"352 %s %s 2 3 4 %s %s 7", sender.Nick, channel, member.Nick, flags)
@@ -375,10 +747,13 @@ func (s *Server) Who(sender *Peer, channel string) error {
 }
 
 func (s *Server) WhoAll(sender *Peer) error {
-	s.Lock()
-	defer s.Unlock()
+	s.RLock()
+	defer s.RUnlock()
 
 	for _, member := range s.Peers {
+		if member.Neighbour != nil || member.IsInvisible() && member != sender {
+			continue
+		}
 		mutual := false
 		for _, room := range s.Rooms {
 			if room.ContainsMember(sender) && room.ContainsMember(member) {
@@ -400,8 +775,8 @@ func (s *Server) WhoAll(sender *Peer) error {
 }
 
 func (s *Server) SendNames(sender *Peer, name string) error {
-	s.Lock()
-	defer s.Unlock()
+	s.RLock()
+	defer s.RUnlock()
 
 	room, exists := s.Rooms[name]
 	if exists {
@@ -414,65 +789,152 @@ func (s *Server) SendNames(sender *Peer, name string) error {
 }
 
 func (s *Server) Join(sender *Peer, name string) error {
+	_, err := s.join(sender, name)
+	return err
+}
+
+// Does the work of Join, also reporting whether sender has been added to
+// the room rather than being in it already.
+func (s *Server) join(sender *Peer, name string) (bool, error) {
 	s.Lock()
 	defer s.Unlock()
 
+	if s.Limits.MaxChannels > 0 {
+		joined := 0
+		for _, room := range s.Rooms {
+			if room.ContainsMember(sender) {
+				joined++
+			}
+		}
+		if joined >= s.Limits.MaxChannels {
+			return false, &TooManyChannels{sender.Nick, name}
+		}
+	}
+
 	room, exists := s.Rooms[name]
+	record, registered := s.Registered[name]
 	if !exists {
-		room = &Room{Members: map[int]*Peer{}}
-		s.Rooms[name] = room
-		sender.IsModOf = append(sender.IsModOf, name)
+		if registered {
+			room = record.NewRoom()
+		} else {
+			room = &Room{Members: map[int]*Member{}, Created: time.Now()}
+		}
 	}
 	if room.ContainsMember(sender) {
-		return nil
+		return false, nil
 	}
-	room.AddMember(sender)
-
-	for _, member := range room.Members {
-		member.SayFrom(sender.Nick+"!u@h", "JOIN %s", name)
+	if room.IsBanned(sender) && !sender.IsGlobalOperator {
+		return false, &BannedFromChannel{sender.Nick, name}
+	}
+	privileges := Privileges(0)
+	if !exists {
+		s.Rooms[name] = room
+		if !registered {
+			privileges = PrivOp
+		}
+	}
+	grant := ""
+	if registered && !sender.IsGlobalOperator {
+		switch s.accessLevel(record, sender) {
+		case AccessFounder, AccessOp:
+			privileges |= PrivOp
+			grant = "+o"
+		case AccessVoice:
+			privileges |= PrivVoice
+			grant = "+v"
+		}
+	}
+	room.AddMember(sender, privileges)
+	s.announceJoin(sender, name, room)
+	s.propagate(sender, s.Name, "NJOIN %s :%s", name, ModePrefixes(room.Modes(sender), true)+sender.Nick)
+
+	if grant != "" {
+		source := s.Name
+		if s.ChanServ != nil {
+			source = chanServSource
+		}
+		line := NewRelay().Line(source, "MODE %s %s %s", name, grant, sender.Nick)
+		defer line.Release()
+		for _, member := range room.Members {
+			line.SendTo(member.Peer)
+		}
 	}
 	if room.Topic != "" {
-		sender.Say("332 %s %s :%s", sender.Nick, name, room.Topic)
+		room.RLock()
+		s.sendTopic(sender, name, room)
+		room.RUnlock()
 	}
 	s.sendNames(sender, name, room, nil)
 	sender.Say("366 %s %s 3", sender.Nick, name)
 
-	return nil
+	return true, nil
+}
+
+// Shows sender joining the room to its members. Must be called with the
+// server locked.
+func (s *Server) announceJoin(sender *Peer, name string, room *Room) {
+	account := sender.Account
+	if account == "" {
+		account = "*"
+	}
+	relay := NewRelay()
+	join := relay.Line(sender.Nick+"!u@h", "JOIN %s", name)
+	defer join.Release()
+	extended := relay.Line(sender.Nick+"!u@h", "JOIN %s %s :%s", name, account, sender.FullName)
+	defer extended.Release()
+	away := NewRelay().Line(sender.Nick+"!u@h", "AWAY :%s", sender.Away)
+	defer away.Release()
+	for _, member := range room.Members {
+		if member.HasCap("extended-join") {
+			extended.SendTo(member.Peer)
+		} else {
+			join.SendTo(member.Peer)
+		}
+		if sender.Away != "" && member.Peer != sender && member.HasCap("away-notify") {
+			away.SendTo(member.Peer)
+		}
+	}
 }
 
 func (s *Server) SendMessage(cmd string, sender *Peer, nick, message string) error {
-	msg := fmt.Sprintf(":%s!%s@c %s %s :%s\r\n", sender.Nick, sender.User, cmd, nick, message)
+	source := sender.Nick + "!" + sender.User + "@c"
+	line := NewRelay().Line(source, "%s %s :%s", cmd, nick, message)
+	defer line.Release()
 
-	s.Lock()
-	defer s.Unlock()
+	s.RLock()
+	defer s.RUnlock()
 
+	key := nick
 	if nick[0] == '#' {
 		room, exists := s.Rooms[nick]
 		if !exists {
 			return &NoSuchUser{sender.Nick, nick}
 		}
 
-		// Make sure the user has joined the channel already.
-		if !room.ContainsMember(sender) {
-			return &CannotSendToChannel{sender.Nick, nick}
-		}
+		room.RLock()
+		defer room.RUnlock()
 
-		voice := false
-		for _, member := range room.Speakers {
-			if member == sender {
-				voice = true
-			}
+		// Unless the room is -n, make sure the user has joined it already.
+		if !room.AllowsExternal && !room.ContainsMember(sender) {
+			return &CannotSendToChannel{sender.Nick, nick}
 		}
 
-		if room.IsModerated && !IsModerator(sender, nick) && !voice {
+		if room.IsModerated && room.Rank(sender) < RankVoice {
 			return &CannotSendToChannel{sender.Nick, nick}
 		}
 
+		start := time.Now()
 		for _, member := range room.Members {
-			if member != sender {
-				member.Write(msg)
+			if member.Peer != sender || sender.HasCap("echo-message") {
+				line.SendTo(member.Peer)
 			}
 		}
+		if s.Metrics != nil {
+			s.Metrics.FanOut.Observe(time.Since(start))
+		}
+		if len(s.Servers) > 0 {
+			s.propagate(sender, sender.Nick, "%s %s :%s", cmd, nick, message)
+		}
 	} else {
 		peer, ok := s.Nicks[nick]
 		if !ok {
@@ -485,154 +947,280 @@ func (s *Server) SendMessage(cmd string, sender *Peer, nick, message string) err
 		if peer.Away != "" {
 			return &PeerIsAway{sender.Nick, nick, peer.Away}
 		}
-		peer.Write(msg)
+		if via := peer.route(); via != nil && via != sender.route() {
+			via.SayFrom(sender.Nick, "%s %s :%s", cmd, nick, message)
+		}
+		line.SendTo(peer)
+		if sender.HasCap("echo-message") && peer != sender {
+			line.SendTo(sender)
+		}
+
+		// Private conversations are kept only between identified users, so
+		// that whoever takes a nick next can't read them.
+		key = ""
+		if sender.Account != "" && peer.Account != "" {
+			key = historyKey(sender.Account, peer.Account)
+		}
+	}
+
+	if s.History != nil && key != "" {
+		err := s.History.Add(key, HistoryMessage{
+			ID:      line.ID(),
+			Time:    line.Time,
+			Source:  source,
+			Command: cmd,
+			Target:  nick,
+			Text:    message,
+		})
+		if err != nil {
+			log.Printf("recording history: %s", err)
+		}
 	}
 	return nil
 }
 
 func (s *Server) SetMode(sender *Peer, subject, mode string) error {
-	s.Lock()
-	defer s.Unlock()
-
-	if subject[0] == '#' {
-		room, ok := s.Rooms[subject]
-		if !ok {
-			return &NoSuchChannel{sender.Nick, subject}
-		}
+	if subject[0] != '#' {
+		return s.setUserModes(sender, subject, mode)
+	}
 
-		if !IsModerator(sender, subject) {
-			return &NotOperator{sender.Nick, subject}
-		}
+	// Registering a channel adds to s.Registered, which needs the server to
+	// itself; other modes only touch the one room.
+	if len(mode) == 2 && mode[1] == 'r' {
+		s.Lock()
+		defer s.Unlock()
+	} else {
+		s.RLock()
+		defer s.RUnlock()
+	}
 
-		if len(mode) != 2 {
-			return &UnknownChannelMode{sender.Nick, subject, '?'}
-		}
+	room, ok := s.Rooms[subject]
+	if !ok {
+		return &NoSuchChannel{sender.Nick, subject}
+	}
 
-		enable := mode[0] == '+'
-		switch mode[1] {
-		case 'm':
-			room.IsModerated = enable
-		case 't':
-			room.IsFixedTopic = enable
-		default:
-			return &UnknownChannelMode{sender.Nick, subject, mode[1]}
-		}
+	room.Lock()
+	defer room.Unlock()
 
-		for _, member := range room.Members {
-			member.SayFrom(sender.Nick+"!u@h", "MODE %s %s", subject, mode)
+	if mode == "+b" || mode == "b" {
+		for _, ban := range room.Bans {
+			sender.Say("367 %s %s %s", sender.Nick, subject, ban)
 		}
+		sender.Say("368 %s %s :End of channel ban list", sender.Nick, subject)
 		return nil
-	} else {
-		if subject != sender.Nick {
-			return &CannotChangeForOtherUser{sender.Nick}
-		}
+	}
 
-		enable := mode[0] == '+'
-		switch mode[1] {
-		case 'o':
-			if enable {
-				return nil
+	if room.Rank(sender) < RankOp {
+		return &NotOperator{sender.Nick, subject}
+	}
+
+	if len(mode) != 2 {
+		return &UnknownChannelMode{sender.Nick, subject, '?'}
+	}
+
+	enable := mode[0] == '+'
+	switch mode[1] {
+	case 'm':
+		room.IsModerated = enable
+	case 't':
+		room.IsFixedTopic = enable
+	case 's':
+		room.IsSecret = enable
+	case 'p':
+		room.IsPrivate = enable
+	case 'n':
+		room.AllowsExternal = !enable
+	case 'r':
+		if enable {
+			if err := s.RegisterChannel(sender, subject, room); err != nil {
+				return err
 			}
-		case 'a':
-			return nil
-		default:
-			return &UnknownUserMode{sender.Nick}
+		} else if err := s.UnregisterChannel(sender, subject); err != nil {
+			return err
 		}
+	default:
+		return &UnknownChannelMode{sender.Nick, subject, mode[1]}
+	}
+	s.saveRoom(subject, room)
+	if mode[1] != 'r' {
+		s.propagate(sender, sender.Nick, "MODE %s %s", subject, mode)
+	}
 
-		sender.SayFrom(sender.Nick, "MODE %s :%s", subject, mode)
+	line := NewRelay().Line(sender.Nick+"!u@h", "MODE %s %s", subject, mode)
+	defer line.Release()
+	for _, member := range room.Members {
+		line.SendTo(member.Peer)
 	}
 	return nil
 }
 
 func (s *Server) GetMode(sender *Peer, subject string) error {
-	s.Lock()
-	defer s.Unlock()
+	if subject[0] != '#' {
+		return s.getUserModes(sender, subject)
+	}
+
+	s.RLock()
+	defer s.RUnlock()
 
 	room, ok := s.Rooms[subject]
 	if !ok {
 		return &NoSuchChannel{sender.Nick, subject}
 	}
 
+	room.RLock()
+	defer room.RUnlock()
+
+	sender.Say("324 %s %s %s", sender.Nick, subject, s.channelModes(subject, room))
+
+	return nil
+}
+
+// Must be called with the server and room at least read-locked.
+func (s *Server) channelModes(name string, room *Room) string {
 	mode := "+"
 	if room.IsModerated {
 		mode = mode + "m"
 	}
+	if !room.AllowsExternal {
+		mode = mode + "n"
+	}
 	if room.IsFixedTopic {
 		mode = mode + "t"
 	}
-
-	sender.Say("324 %s %s %s", sender.Nick, subject, mode)
-
-	return nil
+	if room.IsSecret {
+		mode = mode + "s"
+	}
+	if room.IsPrivate {
+		mode = mode + "p"
+	}
+	if _, ok := s.Registered[name]; ok {
+		mode = mode + "r"
+	}
+	return mode
 }
 
 func (s *Server) SetMembershipMode(sender *Peer, channel, mode, subject string) error {
-	s.Lock()
-	defer s.Unlock()
+	s.RLock()
+	defer s.RUnlock()
 
 	room, ok := s.Rooms[channel]
 	if !ok {
 		return &NoSuchChannel{sender.Nick, channel}
 	}
 
-	if !IsModerator(sender, channel) {
+	room.Lock()
+	defer room.Unlock()
+
+	// Half-ops may only voice people; everything else needs at least +o, and
+	// +a and +q need the same privilege themselves.
+	rank := room.Rank(sender)
+	needed := RankOp
+	switch mode[1] {
+	case 'v':
+		needed = RankHalfOp
+	case 'a':
+		needed = RankAdmin
+	case 'q':
+		needed = RankOwner
+	}
+	if rank < needed {
 		return &NotOperator{sender.Nick, channel}
 	}
 
-	subjectuser := (*Peer)(nil)
-	for _, member := range room.Members {
-		if member.Nick == subject {
-			subjectuser = member
-			break
+	if mode[1] == 'b' {
+		room.SetBan(subject, mode[0] == '+')
+		s.saveRoom(channel, room)
+		s.propagate(sender, sender.Nick, "MODE %s %s %s", channel, mode, subject)
+		line := NewRelay().Line(sender.Nick+"!u@h", "MODE %s %s %s", channel, mode, subject)
+		defer line.Release()
+		for _, member := range room.Members {
+			line.SendTo(member.Peer)
 		}
+		return nil
+	}
+
+	subjectuser := (*Peer)(nil)
+	if p, ok := s.Nicks[subject]; ok && room.ContainsMember(p) {
+		subjectuser = p
 	}
 
 	if subjectuser == nil {
 		return &SubjectNotOnChannel{sender.Nick, channel, subject}
 	}
 
-	enable := mode[0] == '+'
-	switch mode[1] {
-	case 'v':
-		for i, speaker := range room.Speakers {
-			if speaker == subjectuser {
-				room.Speakers = append(room.Speakers[:i], room.Speakers[i+1:]...)
-				break
-			}
-		}
-
-		if enable {
-			room.Speakers = append(room.Speakers, subjectuser)
-		}
-	case 'o':
-		for i, mod_chan := range subjectuser.IsModOf {
-			if mod_chan == channel {
-				subjectuser.IsModOf = append(subjectuser.IsModOf[:i], subjectuser.IsModOf[i+1:]...)
-				break
-			}
-		}
-
-		if enable {
-			subjectuser.IsModOf = append(subjectuser.IsModOf, channel)
-		}
-	default:
+	privilege := PrivilegeFor(mode[1])
+	if privilege == 0 {
 		return &UnknownChannelMode{sender.Nick, channel, mode[1]}
 	}
+	enable := mode[0] == '+'
+	room.SetPrivilege(subjectuser, privilege, enable)
+	if privilege == PrivOp {
+		s.saveAccess(channel, subjectuser, enable)
+	}
+	s.propagate(sender, sender.Nick, "MODE %s %s %s", channel, mode, subject)
 
+	line := NewRelay().Line(sender.Nick+"!u@h", "MODE %s %s %s", channel, mode, subject)
+	defer line.Release()
 	for _, member := range room.Members {
-		member.SayFrom(sender.Nick+"!u@h", "MODE %s %s %s", channel, mode, subject)
+		line.SendTo(member.Peer)
 	}
 
 	return nil
 }
 
+// What LUSERS reports. Users, Operators and Servers cover the whole network;
+// the rest are local.
+type ServerStats struct {
+	Users      int
+	LocalUsers int
+	Clients    int
+	Operators  int
+	Channels   int
+	Servers    int
+	Links      int
+}
+
+// Gathers the counts for LUSERS under a single lock.
+func (s *Server) Stats() ServerStats {
+	s.RLock()
+	defer s.RUnlock()
+
+	stats := ServerStats{
+		Users:      s.UserCount,
+		LocalUsers: s.UserCount,
+		Clients:    len(s.Peers),
+		Channels:   len(s.Rooms),
+		Servers:    len(s.Servers) + 1,
+	}
+	for _, user := range s.Peers {
+		if user.IsOperator() {
+			stats.Operators++
+		}
+	}
+	for _, user := range s.Nicks {
+		if user.Origin != nil {
+			stats.Users++
+			if user.IsGlobalOperator {
+				stats.Operators++
+			}
+		}
+	}
+	for _, srv := range s.Servers {
+		if srv.Hops == 1 {
+			stats.Links++
+		}
+	}
+	stats.Clients -= stats.Links
+	return stats
+}
+
 func (s *Server) NumOps() int {
-	s.Lock()
-	defer s.Unlock()
+	s.RLock()
+	defer s.RUnlock()
 
 	count := 0
 	for _, user := range s.Peers {
-		if user.IsGlobalOperator {
+		if user.IsOperator() {
 			count++
 		}
 	}
@@ -640,15 +1228,15 @@ func (s *Server) NumOps() int {
 }
 
 func (s *Server) NumUsers() int {
-	s.Lock()
-	defer s.Unlock()
+	s.RLock()
+	defer s.RUnlock()
 
 	return s.UserCount
 }
 
 func (s *Server) NumClients() int {
-	s.Lock()
-	defer s.Unlock()
+	s.RLock()
+	defer s.RUnlock()
 
 	return len(s.Peers)
 }
@@ -660,14 +1248,88 @@ func (s *Server) Listen(addr string) error {
 }
 
 func (s *Server) Serve() error {
+	return s.ServeListener(s.Listener)
+}
+
+func (s *Server) ServeListener(ln net.Listener) error {
+	s.Lock()
+	if s.Closing != "" {
+		s.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.Listeners = append(s.Listeners, ln)
+	s.Unlock()
+
 	for {
-		conn, err := s.Listener.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
+			if s.awaitHandover() || s.ShutdownReason() != "" {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// A handoff was attempted and abandoned.
+				ln.(deadliner).SetDeadline(time.Time{})
+				continue
+			}
 			return err
 		}
-		conn.(*net.TCPConn).SetNoDelay(false)
-		peer := s.AddPeer(conn)
-		go peer.HandleInput()
+		if s.awaitHandover() || s.ShutdownReason() != "" {
+			conn.Close()
+			return ErrServerClosed
+		}
+		if s.expectsProxyHeader(conn.RemoteAddr()) {
+			// A proxy may be slow to send its header, so wait for it apart
+			// from the accept loop.
+			go s.acceptProxied(conn)
+			continue
+		}
+		s.accept(conn, conn.RemoteAddr())
+	}
+}
+
+// Reads the PROXY header a trusted proxy begins conn with, and accepts the
+// client it names.
+func (s *Server) acceptProxied(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	addr, err := readProxyHeader(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.accept(conn, addr)
+}
+
+// Takes on a newly accepted connection from addr as a peer, unless the
+// server is full, closing or refuses the address.
+func (s *Server) accept(conn net.Conn, addr net.Addr) {
+	if s.IsFull() {
+		fmt.Fprintf(conn, "ERROR :Closing Link: (Server is full)\r\n")
+		conn.Close()
+		return
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetNoDelay(false)
+	}
+	s.Lock()
+	// Proxied connections are accepted after the loop, which may have
+	// stopped for a shutdown or handoff since.
+	if s.Closing != "" || s.Handover != nil {
+		s.Unlock()
+		conn.Close()
+		return
+	}
+	if err := s.admit(addr); err != nil {
+		s.Unlock()
+		fmt.Fprintf(conn, "%s\r\n", err)
+		conn.Close()
+		return
+	}
+	peer := s.addPeer(conn, hostOf(addr))
+	s.Unlock()
+	if s.connected(peer) {
+		s.readFrom(peer)
 	}
 }
 
@@ -680,10 +1342,112 @@ func (s *Server) ListenAndServe(addr string) error {
 	return s.Serve()
 }
 
+func (s *Server) ShutdownReason() string {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.Closing
+}
+
+func (s *Server) IsHandingOff() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.Handover != nil
+}
+
+// Blocks until any in-progress handoff finishes, returning true if the
+// server's connections now belong to another process.
+func (s *Server) awaitHandover() bool {
+	s.Lock()
+	h := s.Handover
+	s.Unlock()
+
+	if h == nil {
+		return false
+	}
+	<-h.Done
+	return h.Succeeded
+}
+
+// Stops accepting connections, disconnects every peer with an ERROR line,
+// and waits until each has been flushed and removed. If ctx expires first,
+// any remaining connections are closed outright.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.shutdown(ctx, "Server shutting down")
+}
+
+func (s *Server) shutdown(ctx context.Context, reason string) error {
+	s.Lock()
+	if s.Closing == "" {
+		s.Closing = reason
+	}
+	for _, ln := range s.Listeners {
+		ln.Close()
+	}
+	s.Listeners = nil
+	peers := make([]*Peer, 0, len(s.Peers))
+	for _, p := range s.Peers {
+		peers = append(peers, p)
+	}
+	s.Unlock()
+
+	// Interrupt each reader; HandleInput (or its poller) then sends the QUIT to any shared
+	// channels and flushes the peer's output before closing the socket.
+	for _, p := range peers {
+		if p.Conn != nil {
+			p.Conn.SetReadDeadline(time.Now())
+		}
+	}
+	s.interruptPollers()
+
+	done := make(chan bool)
+	go func() {
+		s.Handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, p := range peers {
+			if p.Conn != nil {
+				s.closeConn(p)
+			}
+		}
+		return ctx.Err()
+	}
+}
+
+// Handles DIE and RESTART from an operator.
+func (s *Server) Terminate(restart bool) {
+	if s.OnTerminate != nil {
+		s.OnTerminate(restart)
+		return
+	}
+	reason := "Server shutting down"
+	if restart {
+		reason = "Server restarting"
+	}
+	s.shutdown(context.Background(), reason)
+}
+
+// Returns a reference tag for a BATCH.
+func (s *Server) NewBatchID() string {
+	return strconv.FormatUint(atomic.AddUint64(&s.NextBatchID, 1), 10)
+}
+
 func NewServer() *Server {
 	return &Server{
+		Name:  "s",
 		Peers: map[int]*Peer{},
 		Nicks: map[string]*Peer{},
 		Rooms: map[string]*Room{},
+
+		Commands:   defaultCommands(),
+		Servers:    map[string]*RemoteServer{},
+		Registered: map[string]*ChannelRecord{},
+		Services:   map[string]Service{},
 	}
 }
@@ -0,0 +1,462 @@
+package irc_go
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A pseudo-user living inside the server, such as NickServ. Handle is called
+// for each PRIVMSG addressed to it, without the server lock held.
+type Service interface {
+	Handle(sender *Peer, message string)
+}
+
+type AccountRecord struct {
+	Password   string
+	Email      string
+	Registered time.Time
+	LastSeen   time.Time
+}
+
+// Persists registered nicknames across restarts.
+type AccountStore interface {
+	Load() (map[string]*AccountRecord, error)
+	Save(name string, record *AccountRecord) error
+	Delete(name string) error
+}
+
+// Stores every account in a single JSON file, like FileChannelStore.
+type FileAccountStore struct {
+	Path    string
+	records map[string]*AccountRecord
+	sync.Mutex
+}
+
+func (f *FileAccountStore) Load() (map[string]*AccountRecord, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.records = map[string]*AccountRecord{}
+	buf, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return f.records, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &f.records); err != nil {
+		return nil, err
+	}
+	return f.records, nil
+}
+
+func (f *FileAccountStore) Save(name string, record *AccountRecord) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.records == nil {
+		f.records = map[string]*AccountRecord{}
+	}
+	copy := *record
+	f.records[name] = &copy
+	return writeJSONFile(f.Path, f.records)
+}
+
+func (f *FileAccountStore) Delete(name string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	delete(f.records, name)
+	return writeJSONFile(f.Path, f.records)
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Accepts bcrypt hashes, and the salted SHA-256 ones stored by earlier
+// versions.
+func checkPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	parts := strings.SplitN(hash, "$", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	sum := sha256.Sum256(append(salt, password...))
+	actual := []byte(hex.EncodeToString(sum[:]))
+	return subtle.ConstantTimeCompare(actual, []byte(parts[1])) == 1
+}
+
+// After this many wrong passwords for an account, further attempts are
+// refused until it has gone untried for identifyLockout.
+const (
+	maxIdentifyFailures = 3
+	identifyLockout     = time.Minute
+)
+
+type failedAttempts struct {
+	count int
+	last  time.Time
+}
+
+const nickServSource = "NickServ!NickServ@services"
+
+// Lets users register their nickname, and renames anyone using a registered
+// nick without identifying within the grace period.
+type NickServ struct {
+	Server   *Server
+	Store    AccountStore
+	Accounts map[string]*AccountRecord
+	Grace    time.Duration
+
+	pending  map[*Peer]*time.Timer
+	failures map[string]*failedAttempts
+}
+
+func (s *Server) EnableNickServ(store AccountStore, grace time.Duration) error {
+	accounts, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	n := &NickServ{
+		Server:   s,
+		Store:    store,
+		Accounts: accounts,
+		Grace:    grace,
+		pending:  map[*Peer]*time.Timer{},
+		failures: map[string]*failedAttempts{},
+	}
+	s.NickServ = n
+	s.addService("NickServ", "Nickname Services", n)
+	return nil
+}
+
+// Reserves the nick for the service and routes its messages. Must be called
+// with the server locked.
+func (s *Server) addService(nick, fullname string, svc Service) {
+	s.Services[strings.ToLower(nick)] = svc
+	s.Nicks[nick] = &Peer{
+		Key:      -1,
+		Server:   s,
+		Nick:     nick,
+		User:     nick,
+		Host:     "services",
+		FullName: fullname,
+	}
+}
+
+func (n *NickServ) reply(p *Peer, format string, args ...interface{}) {
+	p.SayFrom(nickServSource, "NOTICE %s :%s", p.Nick, fmt.Sprintf(format, args...))
+}
+
+func (n *NickServ) save(name string) {
+	if err := n.Store.Save(name, n.Accounts[name]); err != nil {
+		log.Printf("saving account %s: %s", name, err)
+	}
+}
+
+func (n *NickServ) Handle(sender *Peer, message string) {
+	n.Server.Lock()
+	defer n.Server.Unlock()
+
+	words := strings.Fields(message)
+	if len(words) == 0 {
+		n.reply(sender, "Available commands: REGISTER, IDENTIFY, GHOST, DROP, INFO")
+		return
+	}
+
+	switch strings.ToUpper(words[0]) {
+	case "REGISTER":
+		n.register(sender, words[1:])
+	case "IDENTIFY":
+		n.identify(sender, words[1:])
+	case "GHOST":
+		n.ghost(sender, words[1:])
+	case "DROP":
+		n.drop(sender, words[1:])
+	case "INFO":
+		n.info(sender, words[1:])
+	default:
+		n.reply(sender, "Unknown command %s. Available commands: REGISTER, IDENTIFY, GHOST, DROP, INFO", words[0])
+	}
+}
+
+func (n *NickServ) login(p *Peer, account string) {
+	p.Account = account
+	n.Accounts[account].LastSeen = time.Now()
+	n.save(account)
+	// Only the nick's own account lifts the deadline to give it up.
+	if t := n.pending[p]; t != nil && account == p.Nick {
+		t.Stop()
+		delete(n.pending, p)
+	}
+	p.Say("900 %s %s %s :You are now logged in as %s",
+		p.Nick, p.Hostmask(), account, account)
+	n.Server.notifyAccount(p)
+}
+
+func (n *NickServ) register(sender *Peer, args []string) {
+	if len(args) < 1 {
+		n.reply(sender, "Syntax: REGISTER <password> [email]")
+		return
+	}
+	nick := sender.Nick
+	if _, ok := n.Accounts[nick]; ok {
+		n.reply(sender, "%s is already registered.", nick)
+		return
+	}
+
+	// Hashing is slow on purpose, so let everyone else carry on meanwhile.
+	n.Server.Unlock()
+	hash, err := hashPassword(args[0])
+	n.Server.Lock()
+	if err != nil {
+		n.reply(sender, "That password can't be used: %s.", err)
+		return
+	}
+	if _, ok := n.Accounts[nick]; ok {
+		n.reply(sender, "%s is already registered.", nick)
+		return
+	}
+	record := &AccountRecord{
+		Password:   hash,
+		Registered: time.Now(),
+	}
+	if len(args) > 1 {
+		record.Email = args[1]
+	}
+	n.Accounts[nick] = record
+	n.reply(sender, "%s is now registered to you.", nick)
+	n.login(sender, nick)
+}
+
+func (n *NickServ) identify(sender *Peer, args []string) {
+	account := sender.Nick
+	if len(args) == 2 {
+		account = args[0]
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		n.reply(sender, "Syntax: IDENTIFY [account] <password>")
+		return
+	}
+
+	if _, ok := n.Accounts[account]; !ok {
+		n.reply(sender, "%s is not registered.", account)
+		return
+	}
+	if !n.checkPassword(sender, account, args[0]) {
+		return
+	}
+	n.reply(sender, "You are now identified for %s.", account)
+	n.login(sender, account)
+}
+
+// Checks password against the account, telling sender why if it's refused.
+// Repeated failures lock the account against further guesses for a while;
+// a success clears them, and upgrades an old hash.
+//
+// The server lock is released while the password is compared, so callers
+// must look up anything else they need again afterwards.
+func (n *NickServ) checkPassword(sender *Peer, account, password string) bool {
+	record := n.Accounts[account]
+	failed := n.failures[account]
+	if failed != nil && time.Since(failed.last) >= identifyLockout {
+		delete(n.failures, account)
+		failed = nil
+	}
+	if failed != nil && failed.count >= maxIdentifyFailures {
+		n.reply(sender, "Too many failed attempts for %s. Try again later.", account)
+		return false
+	}
+	// Count the attempt as a failure until it succeeds, so that guesses made
+	// while this one is being compared are limited too.
+	if failed == nil {
+		failed = &failedAttempts{}
+		n.failures[account] = failed
+	}
+	failed.count++
+	failed.last = time.Now()
+
+	hash := record.Password
+	n.Server.Unlock()
+	ok := checkPassword(hash, password)
+	upgraded := ""
+	if ok && !strings.HasPrefix(hash, "$2") {
+		upgraded, _ = hashPassword(password)
+	}
+	n.Server.Lock()
+
+	if n.Accounts[account] != record {
+		n.reply(sender, "%s is not registered.", account)
+		return false
+	}
+	if !ok {
+		n.reply(sender, "Invalid password for %s.", account)
+		return false
+	}
+
+	delete(n.failures, account)
+	if upgraded != "" && record.Password == hash {
+		record.Password = upgraded
+		n.save(account)
+	}
+	return true
+}
+
+func (n *NickServ) ghost(sender *Peer, args []string) {
+	if len(args) < 1 {
+		n.reply(sender, "Syntax: GHOST <nick> [password]")
+		return
+	}
+	nick := args[0]
+	if _, ok := n.Accounts[nick]; !ok {
+		n.reply(sender, "%s is not registered.", nick)
+		return
+	}
+	if sender.Account != nick && len(args) < 2 {
+		n.reply(sender, "Access denied.")
+		return
+	}
+	if sender.Account != nick && !n.checkPassword(sender, nick, args[1]) {
+		return
+	}
+	target := n.Server.Nicks[nick]
+	if target == nil || target == sender || target.Key < 0 {
+		n.reply(sender, "%s is not online.", nick)
+		return
+	}
+
+	reason := "GHOST command used by " + sender.Nick
+	n.Server.quit(target, reason)
+	target.Say("ERROR :Closing Link: (%s)", reason)
+	delete(n.Server.Nicks, nick)
+	target.Nick = ""
+	n.Server.interruptReader(target)
+	n.reply(sender, "%s has been ghosted.", nick)
+}
+
+func (n *NickServ) drop(sender *Peer, args []string) {
+	account := sender.Account
+	if account == "" {
+		n.reply(sender, "You are not identified.")
+		return
+	}
+	if len(args) > 0 && !n.checkPassword(sender, account, args[0]) {
+		return
+	}
+	if sender.Account != account {
+		n.reply(sender, "You are not identified.")
+		return
+	}
+
+	delete(n.Accounts, account)
+	if err := n.Store.Delete(account); err != nil {
+		log.Printf("deleting account %s: %s", account, err)
+	}
+	for _, p := range n.Server.Peers {
+		if p.Account == account {
+			p.Account = ""
+			n.Server.notifyAccount(p)
+		}
+	}
+	n.reply(sender, "%s has been dropped.", account)
+}
+
+func (n *NickServ) info(sender *Peer, args []string) {
+	nick := sender.Nick
+	if len(args) > 0 {
+		nick = args[0]
+	}
+	record, ok := n.Accounts[nick]
+	if !ok {
+		n.reply(sender, "%s is not registered.", nick)
+		return
+	}
+
+	n.reply(sender, "Information on %s:", nick)
+	n.reply(sender, "Registered: %s", record.Registered.Format(time.RFC1123))
+	online := false
+	for _, p := range n.Server.Peers {
+		if p.Account == nick {
+			online = true
+		}
+	}
+	if online {
+		n.reply(sender, "Last seen: now")
+	} else {
+		n.reply(sender, "Last seen: %s", record.LastSeen.Format(time.RFC1123))
+	}
+}
+
+// Warns a peer that has just taken a registered nick, and schedules it to be
+// renamed unless they identify in time. Must be called with the server
+// locked.
+func (n *NickServ) checkNick(p *Peer) {
+	if t := n.pending[p]; t != nil {
+		t.Stop()
+		delete(n.pending, p)
+	}
+	if _, ok := n.Accounts[p.Nick]; !ok || p.Account == p.Nick {
+		return
+	}
+
+	n.reply(p, "%s is registered. Identify with /msg NickServ IDENTIFY <password> within %s, or choose another nick.",
+		p.Nick, n.Grace)
+	nick := p.Nick
+	n.pending[p] = time.AfterFunc(n.Grace, func() {
+		n.enforce(p, nick)
+	})
+}
+
+func (n *NickServ) enforce(p *Peer, nick string) {
+	s := n.Server
+	s.Lock()
+	defer s.Unlock()
+
+	delete(n.pending, p)
+	if s.Peers[p.Key] != p || p.Nick != nick || p.Account == nick {
+		return
+	}
+
+	guest := fmt.Sprintf("Guest%d", p.Key)
+	for s.Nicks[guest] != nil {
+		guest += "_"
+	}
+
+	shared := false
+	for _, room := range s.Rooms {
+		if room.ContainsMember(p) {
+			shared = true
+		}
+	}
+	if !shared {
+		NewRelay().Send(p, p.Nick+"!u@h", "NICK :%s", guest)
+	}
+	if err := s.setNick(p, guest); err != nil {
+		log.Printf("renaming %s: %s", nick, err)
+		return
+	}
+	n.reply(p, "You have been renamed to %s, since %s is registered.", guest, nick)
+}
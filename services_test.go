@@ -0,0 +1,214 @@
+package irc_go_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/fatlotus/fast-irc-golang"
+)
+
+func TestNickServ(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	s := NewServer()
+	store := &FileAccountStore{Path: tmpdir + "/accounts.json"}
+	if err := s.EnableNickServ(store, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := register(t, s, "alice")
+	if err := alice.Route("PRIVMSG", []string{"NickServ"}, "REGISTER hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if alice.Account != "alice" {
+		t.Fatalf("expected alice to be logged in, got %q", alice.Account)
+	}
+	mallory := register(t, s, "mallory")
+	for _, nick := range []string{"NickServ", "nickserv"} {
+		if err := s.SetNick(mallory, nick); err == nil {
+			t.Errorf("expected %s to be reserved", nick)
+		}
+	}
+
+	// Someone else grabs the nick while alice is away.
+	s.RemovePeer(alice)
+	impostor := register(t, s, "alice")
+	time.Sleep(50 * time.Millisecond)
+	if nickOf(s, impostor) == "alice" {
+		t.Errorf("expected the unidentified user to be renamed")
+	}
+
+	// The real alice comes back under a different nick and reclaims hers.
+	owner := register(t, s, "alice2")
+	if err := s.SetNick(impostor, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	owner.Route("NS", []string{"IDENTIFY", "alice"}, "wrong")
+	if owner.Account != "" {
+		t.Errorf("a bad password should not log in")
+	}
+	owner.Route("NS", []string{"IDENTIFY", "alice", "hunter2"}, "")
+	if owner.Account != "alice" {
+		t.Fatalf("expected to be identified, got %q", owner.Account)
+	}
+	owner.Route("NS", []string{"GHOST", "alice"}, "")
+	if s.Nicks["alice"] != nil {
+		t.Fatalf("expected the ghost to release the nick")
+	}
+	if err := s.SetNick(owner, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if nick := nickOf(s, owner); nick != "alice" {
+		t.Errorf("an identified user should keep their nick, got %q", nick)
+	}
+
+	// Guessing is cut off after a few wrong passwords, even the right one.
+	guesser := register(t, s, "guesser")
+	for i := 0; i < 3; i++ {
+		guesser.Route("NS", []string{"IDENTIFY", "alice"}, "guess")
+	}
+	guesser.Route("NS", []string{"IDENTIFY", "alice", "hunter2"}, "")
+	if guesser.Account != "" {
+		t.Errorf("expected identification to be throttled")
+	}
+
+	// Accounts survive a restart.
+	s = NewServer()
+	if err := s.EnableNickServ(&FileAccountStore{Path: store.Path}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	again := register(t, s, "alice")
+	again.Route("PRIVMSG", []string{"nickserv"}, "IDENTIFY hunter2")
+	if again.Account != "alice" {
+		t.Fatalf("expected the account to persist")
+	}
+	again.Route("PRIVMSG", []string{"nickserv"}, "DROP")
+	if again.Account != "" || s.NickServ.Accounts["alice"] != nil {
+		t.Errorf("expected the account to be dropped")
+	}
+}
+
+// Identifying to some other account doesn't let a user keep a registered
+// nick.
+func TestNickServOtherAccount(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	s := NewServer()
+	store := &FileAccountStore{Path: tmpdir + "/accounts.json"}
+	if err := s.EnableNickServ(store, 300*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := register(t, s, "alice")
+	alice.Route("NS", []string{"REGISTER"}, "hunter2")
+	mallory := register(t, s, "mallory")
+	mallory.Route("NS", []string{"REGISTER"}, "letmein")
+	s.RemovePeer(alice)
+	if err := s.SetNick(mallory, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	mallory.Route("NS", []string{"IDENTIFY", "mallory"}, "letmein")
+	if mallory.Account != "mallory" {
+		t.Fatalf("expected mallory to be identified, got %q", mallory.Account)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if nickOf(s, mallory) == "alice" {
+		t.Errorf("expected mallory to be renamed")
+	}
+}
+
+// Reads p's nick under the server lock, since NickServ may be renaming it.
+func nickOf(s *Server, p *Peer) string {
+	s.RLock()
+	defer s.RUnlock()
+	return p.Nick
+}
+
+func TestChanServ(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "chanserv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	s := NewServer()
+	if err := s.EnableNickServ(&FileAccountStore{Path: tmpdir + "/accounts.json"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.OpenChannelStore(&FileChannelStore{Path: tmpdir + "/channels.json"}); err != nil {
+		t.Fatal(err)
+	}
+	s.EnableChanServ()
+
+	alice := register(t, s, "alice")
+	bob := register(t, s, "bob")
+	carol := register(t, s, "carol")
+	alice.Route("PRIVMSG", []string{"NickServ"}, "REGISTER a-password")
+	bob.Route("PRIVMSG", []string{"NickServ"}, "REGISTER b-password")
+
+	if err := s.Join(alice, "#room"); err != nil {
+		t.Fatal(err)
+	}
+	alice.Route("PRIVMSG", []string{"ChanServ"}, "REGISTER #room")
+	if record := s.Registered["#room"]; record == nil || record.Founder != "alice" {
+		t.Fatalf("expected alice to found #room, got %#v", record)
+	}
+
+	// Only the founder may change the access list.
+	bob.Route("PRIVMSG", []string{"ChanServ"}, "ACCESS #room ADD bob op")
+	if len(s.Registered["#room"].Access) != 0 {
+		t.Errorf("non-founders should not be able to add access")
+	}
+	alice.Route("PRIVMSG", []string{"ChanServ"}, "ACCESS #room ADD bob op")
+	alice.Route("PRIVMSG", []string{"ChanServ"}, "ACCESS #room ADD carol!*@* voice")
+	if err := s.Part(alice, "#room", ""); err != nil {
+		t.Fatal(err)
+	}
+	if s.Rooms["#room"] != nil {
+		t.Fatalf("expected the room to be empty")
+	}
+
+	if err := s.Join(carol, "#room"); err != nil {
+		t.Fatal(err)
+	}
+	if IsModerator(carol, "#room") {
+		t.Errorf("carol should not be opped")
+	}
+	if modes := s.Rooms["#room"].Modes(carol); modes != "v" {
+		t.Errorf("expected carol to be voiced, got %q", modes)
+	}
+
+	if err := s.Join(bob, "#room"); err != nil {
+		t.Fatal(err)
+	}
+	if !IsModerator(bob, "#room") {
+		t.Errorf("expected bob to be opped on join")
+	}
+
+	alice.Route("PRIVMSG", []string{"ChanServ"}, "DROP #room")
+	if s.Registered["#room"] != nil {
+		t.Errorf("expected the channel to be dropped")
+	}
+
+	// MODE +r needs the same identification as REGISTER.
+	if err := s.Join(carol, "#carols"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.SetMode(carol, "#carols", "+r").(*NeedsIdentification); !ok {
+		t.Errorf("expected an unidentified user to be refused")
+	}
+	if s.Registered["#carols"] != nil {
+		t.Errorf("expected #carols to stay unregistered")
+	}
+}
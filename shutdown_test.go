@@ -0,0 +1,112 @@
+package irc_go_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/fatlotus/fast-irc-golang"
+)
+
+func TestShutdown(t *testing.T) {
+	s := NewServer()
+	if err := s.Listen("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	addr := s.Listener.Addr().String()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve()
+	}()
+
+	a, err := NewClient("a", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewClient("b", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	a.Join("#chan")
+	b.Join("#chan")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("expected ErrServerClosed, got %v", err)
+	}
+
+	for _, c := range []*Client{a, b} {
+		sawError := false
+		for {
+			line, err := c.Reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			if strings.Contains(line, "ERROR :Closing Link: (Server shutting down)") {
+				sawError = true
+			}
+		}
+		if !sawError {
+			t.Errorf("expected an ERROR line before the connection closed")
+		}
+	}
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("expected the listener to be closed")
+	}
+	if s.NumClients() != 0 {
+		t.Errorf("leaked %d peers", s.NumClients())
+	}
+	if len(s.Rooms) != 0 {
+		t.Errorf("leaked rooms: %#v", s.Rooms)
+	}
+}
+
+func TestDie(t *testing.T) {
+	s := NewServer()
+	s.Password = "foobar"
+	if err := s.Listen("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+
+	terminated := make(chan bool, 1)
+	s.OnTerminate = func(restart bool) {
+		terminated <- restart
+	}
+
+	c, err := NewClient("a", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer s.Shutdown(context.Background())
+
+	c.Writer.WriteString("DIE\r\n")
+	c.Writer.Flush()
+	line, _ := c.Reader.ReadString('\n')
+	if !strings.Contains(line, " 481 ") {
+		t.Errorf("expected ERR_NOPRIVILEGES, got %q", line)
+	}
+
+	c.Writer.WriteString("OPER a foobar\r\nRESTART\r\n")
+	c.Writer.Flush()
+	select {
+	case restart := <-terminated:
+		if !restart {
+			t.Errorf("expected a restart")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("RESTART was not delivered")
+	}
+}
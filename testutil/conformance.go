@@ -168,11 +168,22 @@ func RunTestCase(motd, addr string, inputs []string) ([]string, error) {
 }
 
 func DiffTestCase(motd, addr string, expected []string) error {
+	return DiffTestCaseRewriting(motd, addr, expected, nil)
+}
+
+// Like DiffTestCase, but first passes each line received, and each one
+// expected, through rewrite, so that the caller can blank out anything the
+// test case can't know in advance.
+func DiffTestCaseRewriting(motd, addr string, expected []string, rewrite func(string) string) error {
 	actual, err := RunTestCase(motd, addr, expected)
 	if err != nil {
 		return err
 	}
 
+	if rewrite != nil {
+		actual = rewriteLines(actual, rewrite)
+		expected = rewriteLines(expected, rewrite)
+	}
 	actual = NormalizeTestCase(actual)
 	expected = NormalizeTestCase(expected)
 
@@ -191,6 +202,14 @@ func DiffTestCase(motd, addr string, expected []string) error {
 	return &DiffError{Actual: actual, Expected: expected}
 }
 
+func rewriteLines(lines []string, rewrite func(string) string) []string {
+	result := make([]string, len(lines))
+	for i, line := range lines {
+		result[i] = rewrite(line)
+	}
+	return result
+}
+
 type DiffError struct {
 	Expected, Actual []string
 }
@@ -0,0 +1,125 @@
+package irc_go
+
+import (
+	"net"
+	"time"
+)
+
+// Recent connections from one address, for the throttle.
+type connectRate struct {
+	count       int
+	since       time.Time
+	bannedUntil time.Time
+}
+
+// Decides whether a new connection from addr may be accepted, counting it
+// towards the throttle if so. Must be called with the server locked.
+//
+// Only IP addresses are limited. Pipes and unix sockets, whose peers all
+// share a host such as "pipe", come from within the machine and are exempt.
+func (s *Server) admit(addr net.Addr) error {
+	ip := net.ParseIP(hostOf(addr))
+	if ip == nil {
+		return nil
+	}
+	if s.ConnectExempt.Contains(ip) {
+		return nil
+	}
+	limits := s.Limits
+
+	if limits.MaxPerIP > 0 || limits.MaxPerCIDR > 0 {
+		sameIP, sameNetwork := s.perIP[ip.String()], 0
+		if limits.MaxPerCIDR > 0 {
+			network := cidrOf(ip, limits)
+			for addr, n := range s.perIP {
+				if network.Contains(net.ParseIP(addr)) {
+					sameNetwork += n
+				}
+			}
+		}
+		if limits.MaxPerIP > 0 && sameIP >= limits.MaxPerIP {
+			return &ConnectionRefused{"Too many connections from your host"}
+		}
+		if limits.MaxPerCIDR > 0 && sameNetwork >= limits.MaxPerCIDR {
+			return &ConnectionRefused{"Too many connections from your network"}
+		}
+	}
+
+	if limits.ThrottleConnections > 0 && limits.ThrottleSeconds > 0 {
+		now := time.Now()
+		window := time.Duration(limits.ThrottleSeconds) * time.Second
+		ban := time.Duration(limits.ThrottleBanSeconds) * time.Second
+		if s.throttle == nil {
+			s.throttle = map[string]*connectRate{}
+		}
+		key := ip.String()
+		// A lapsed ban starts the count afresh.
+		rate, ok := s.throttle[key]
+		if !ok || rate.expired(now, window) {
+			if len(s.throttle) > 1024 {
+				s.expireThrottle(now, window)
+			}
+			rate = &connectRate{since: now}
+			s.throttle[key] = rate
+		}
+		if now.Before(rate.bannedUntil) {
+			return &ConnectionRefused{"Throttled: reconnecting too fast"}
+		}
+		rate.count++
+		if rate.count > limits.ThrottleConnections {
+			rate.bannedUntil = now.Add(ban)
+			return &ConnectionRefused{"Throttled: reconnecting too fast"}
+		}
+	}
+	return nil
+}
+
+// Counts a connection opening (delta 1) or closing (delta -1) from addr,
+// for the per-address limits. Must be called with the server locked.
+func (s *Server) countAddr(addr string, delta int) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return
+	}
+	if s.perIP == nil {
+		s.perIP = map[string]int{}
+	}
+	key := ip.String()
+	if s.perIP[key] += delta; s.perIP[key] <= 0 {
+		delete(s.perIP, key)
+	}
+}
+
+func (r *connectRate) expired(now time.Time, window time.Duration) bool {
+	if !r.bannedUntil.IsZero() {
+		return now.After(r.bannedUntil)
+	}
+	return now.Sub(r.since) > window
+}
+
+// Forgets addresses that haven't connected lately.
+func (s *Server) expireThrottle(now time.Time, window time.Duration) {
+	for key, rate := range s.throttle {
+		if rate.expired(now, window) {
+			delete(s.throttle, key)
+		}
+	}
+}
+
+// The network ip belongs to for MaxPerCIDR.
+func cidrOf(ip net.IP, limits Limits) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		bits := limits.CIDRv4
+		if bits <= 0 || bits > 32 {
+			bits = 24
+		}
+		mask := net.CIDRMask(bits, 32)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+	bits := limits.CIDRv6
+	if bits <= 0 || bits > 128 {
+		bits = 64
+	}
+	mask := net.CIDRMask(bits, 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
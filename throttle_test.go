@@ -0,0 +1,131 @@
+package irc_go_test
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/fatlotus/fast-irc-golang"
+)
+
+func startLimitedServer(t *testing.T, limits Limits) (*Server, string) {
+	s := NewServer()
+	s.Limits = limits
+	if err := s.Listen("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	return s, s.Listener.Addr().String()
+}
+
+// Connects and returns the first line the server sends, if any.
+func firstLine(t *testing.T, addr, nick string) (*Client, string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("NICK " + nick + "\r\nUSER " + nick + " * * :" + nick + "\r\n"))
+	c := &Client{Conn: conn, Reader: bufio.NewReader(conn)}
+	line, _ := c.Reader.ReadString('\n')
+	return c, line
+}
+
+func TestConnectionLimits(t *testing.T) {
+	s, addr := startLimitedServer(t, Limits{MaxPerIP: 2})
+	defer s.Listener.Close()
+
+	clients := []*Client{}
+	for _, nick := range []string{"a", "b"} {
+		c, line := firstLine(t, addr, nick)
+		defer c.Close()
+		if line != ":s 001 "+nick+" :Welcome to the Internet Relay Network "+nick+"!"+nick+"@foo\r\n" {
+			t.Errorf("expected %s to be welcomed, got %q", nick, line)
+		}
+		clients = append(clients, c)
+	}
+	c, line := firstLine(t, addr, "c")
+	c.Close()
+	if line != "ERROR :Closing Link: (Too many connections from your host)\r\n" {
+		t.Errorf("expected the third connection to be refused, got %q", line)
+	}
+
+	// Once one leaves, another may take its place.
+	clients[0].Close()
+	for s.NumClients() > 1 {
+		time.Sleep(time.Millisecond)
+	}
+	c, line = firstLine(t, addr, "c")
+	c.Close()
+	if !strings.HasPrefix(line, ":s 001") {
+		t.Errorf("expected a freed slot to be reused, got %q", line)
+	}
+	for s.NumClients() > 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	s.Lock()
+	s.ConnectExempt = CIDRList{loopback}
+	s.Unlock()
+	c, line = firstLine(t, addr, "c")
+	defer c.Close()
+	if !strings.HasPrefix(line, ":s 001") {
+		t.Errorf("expected an exempt address to be let in, got %q", line)
+	}
+}
+
+func TestConnectionLimitPerNetwork(t *testing.T) {
+	s, addr := startLimitedServer(t, Limits{MaxPerCIDR: 1, CIDRv4: 8})
+	defer s.Listener.Close()
+
+	a, _ := firstLine(t, addr, "a")
+	defer a.Close()
+	b, line := firstLine(t, addr, "b")
+	b.Close()
+	if line != "ERROR :Closing Link: (Too many connections from your network)\r\n" {
+		t.Errorf("expected the second connection to be refused, got %q", line)
+	}
+}
+
+func TestConnectionThrottle(t *testing.T) {
+	s, addr := startLimitedServer(t, Limits{
+		ThrottleConnections: 2,
+		ThrottleSeconds:     60,
+		ThrottleBanSeconds:  1,
+	})
+	defer s.Listener.Close()
+
+	for _, nick := range []string{"a", "b"} {
+		c, _ := firstLine(t, addr, nick)
+		c.Close()
+	}
+	for i := 0; i < 2; i++ {
+		c, line := firstLine(t, addr, "c")
+		c.Close()
+		if line != "ERROR :Closing Link: (Throttled: reconnecting too fast)\r\n" {
+			t.Errorf("expected to be throttled, got %q", line)
+		}
+	}
+
+	// Once the ban lapses, the address is let in again.
+	time.Sleep(1100 * time.Millisecond)
+	c, line := firstLine(t, addr, "d")
+	c.Close()
+	if !strings.HasPrefix(line, ":s 001") {
+		t.Errorf("expected the ban to have lapsed, got %q", line)
+	}
+}
+
+func TestPipesAreNotLimited(t *testing.T) {
+	s := NewServer()
+	s.Limits = Limits{MaxPerIP: 1, ThrottleConnections: 1, ThrottleSeconds: 60}
+	for _, nick := range []string{"a", "b", "c"} {
+		c, err := NewPipeClient(nick, s)
+		if err != nil {
+			t.Fatalf("expected %s to be let in, got %s", nick, err)
+		}
+		defer c.Close()
+	}
+}
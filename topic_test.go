@@ -0,0 +1,73 @@
+package irc_go_test
+
+import (
+	"bufio"
+	"context"
+	"strings"
+	"testing"
+
+	. "github.com/fatlotus/fast-irc-golang"
+)
+
+func TestTopicMetadata(t *testing.T) {
+	s := NewServer()
+	s.Limits.TopicLen = 10
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewPipeClient("a", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	send(a, "JOIN #chan")
+	readUntil(t, a, "366 a #chan")
+
+	// Topics are cut short, without splitting a character.
+	send(a, "TOPIC #chan :abcdefghié")
+	readUntil(t, a, "TOPIC #chan :abcdefghi\r\n")
+
+	// Clients learn who set it, on joining and on asking.
+	conn, err := s.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Client{Conn: conn, Reader: bufio.NewReader(conn), Writer: bufio.NewWriter(conn)}
+	defer b.Close()
+	send(b, "NICK b")
+	send(b, "USER b * * :b")
+	readUntil(t, b, "TOPICLEN=10")
+	readUntil(t, b, "422 b")
+
+	send(b, "JOIN #chan")
+	readUntil(t, b, "332 b #chan :abcdefghi")
+	if line := readUntil(t, b, "333"); !strings.HasPrefix(line, ":s 333 b #chan a!a@pipe ") {
+		t.Errorf("unexpected setter %q", line)
+	}
+	send(b, "TOPIC #chan")
+	readUntil(t, b, "332 b #chan :abcdefghi")
+	readUntil(t, b, "333 b #chan a!a@pipe ")
+
+	// LIST leaves the topic alone, but can pick out recently set ones.
+	send(b, "LIST T<1")
+	readUntil(t, b, "322 b #chan 2 :abcdefghi")
+	send(b, "LIST T>1")
+	readUntilWithout(t, b, "323 b :End of LIST", "322")
+
+	// An empty trailing parameter clears the topic.
+	send(a, "TOPIC #chan :")
+	readUntil(t, b, ":a!u@h TOPIC #chan :\r\n")
+	send(b, "TOPIC #chan")
+	readUntil(t, b, "331 b #chan :No topic is set")
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Stop(context.Background())
+	}()
+	readUntil(t, a, "ERROR")
+	readUntil(t, b, "ERROR")
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+}
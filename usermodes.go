@@ -0,0 +1,174 @@
+package irc_go
+
+// User modes besides +o, which IsGlobalOperator records, and +r, which
+// follows from Account.
+type UserModes uint8
+
+const (
+	ModeInvisible     UserModes = 1 << iota // +i: hidden from those sharing no channel
+	ModeWallops                             // +w: receives WALLOPS
+	ModeLocalOperator                       // +O: an operator on this server only
+	ModeBot                                 // +B: a bot, as WHOIS and WHO show
+)
+
+var userModeLetters = []struct {
+	mode   UserModes
+	letter byte
+}{
+	{ModeInvisible, 'i'},
+	{ModeWallops, 'w'},
+	{ModeLocalOperator, 'O'},
+	{ModeBot, 'B'},
+}
+
+// Whether p may use operator commands on this server.
+func (p *Peer) IsOperator() bool {
+	return p.IsGlobalOperator || p.UserModes&ModeLocalOperator != 0
+}
+
+func (p *Peer) IsInvisible() bool {
+	return p.UserModes&ModeInvisible != 0
+}
+
+// The peer's modes as a string such as "+iw". Must be called with the
+// server locked.
+func (p *Peer) UserModeString() string {
+	modes := "+"
+	if p.IsGlobalOperator {
+		modes += "o"
+	}
+	for _, m := range userModeLetters {
+		if p.UserModes&m.mode != 0 {
+			modes += string(m.letter)
+		}
+	}
+	if p.Account != "" {
+		modes += "r"
+	}
+	return modes
+}
+
+// Applies a mode string such as "+iw-B" to p, returning the changes made in
+// the same form. Users may drop +o and +O but only OPER grants them, and +r
+// and +a are the server's to set, so requests for those are ignored; over a
+// link, +o is believed. Must be called with the server locked.
+func (p *Peer) applyUserModes(mode string, fromLink bool) (applied string, unknown bool) {
+	sign, last := byte('+'), byte(0)
+	for i := 0; i < len(mode); i++ {
+		c := mode[i]
+		if c == '+' || c == '-' {
+			sign = c
+			continue
+		}
+		enable := sign == '+'
+
+		changed := false
+		switch c {
+		case 'o':
+			if !enable || fromLink {
+				p.IsGlobalOperator = enable
+				changed = true
+			}
+		case 'O':
+			if !enable {
+				p.UserModes &^= ModeLocalOperator
+				changed = true
+			}
+		case 'a', 'r':
+		default:
+			known := false
+			for _, m := range userModeLetters {
+				if m.letter == c && m.mode != ModeLocalOperator {
+					if enable {
+						p.UserModes |= m.mode
+					} else {
+						p.UserModes &^= m.mode
+					}
+					known, changed = true, true
+				}
+			}
+			if !known {
+				unknown = true
+			}
+		}
+		if changed {
+			if sign != last {
+				applied += string(sign)
+				last = sign
+			}
+			applied += string(c)
+		}
+	}
+	return applied, unknown
+}
+
+func (s *Server) setUserModes(sender *Peer, subject, mode string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if subject != sender.Nick {
+		return &CannotChangeForOtherUser{sender.Nick}
+	}
+	applied, unknown := sender.applyUserModes(mode, false)
+	if applied != "" {
+		NewRelay().Send(sender, sender.Nick, "MODE %s :%s", subject, applied)
+		if linked := withoutLocalModes(applied); linked != "" {
+			s.propagate(sender, sender.Nick, "MODE %s :%s", subject, linked)
+		}
+	}
+	if unknown {
+		return &UnknownUserMode{sender.Nick}
+	}
+	return nil
+}
+
+// Leaves out +O, which means nothing on other servers.
+func withoutLocalModes(mode string) string {
+	out, sign, last := "", byte('+'), byte(0)
+	for i := 0; i < len(mode); i++ {
+		switch c := mode[i]; c {
+		case '+', '-':
+			sign = c
+		case 'O':
+		default:
+			if sign != last {
+				out += string(sign)
+				last = sign
+			}
+			out += string(c)
+		}
+	}
+	return out
+}
+
+func (s *Server) getUserModes(sender *Peer, subject string) error {
+	s.RLock()
+	defer s.RUnlock()
+
+	if _, ok := s.Nicks[subject]; !ok {
+		return &NoSuchUser{sender.Nick, subject}
+	}
+	if subject != sender.Nick {
+		return &CannotChangeForOtherUser{sender.Nick}
+	}
+	sender.Say("221 %s %s", sender.Nick, sender.UserModeString())
+	return nil
+}
+
+// Sends an operator's message to everyone on the network with +w.
+func (s *Server) Wallops(sender *Peer, message string) {
+	line := NewRelay().Line(sender.Nick+"!u@h", "WALLOPS :%s", message)
+	defer line.Release()
+
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, p := range s.Peers {
+		if p.UserModes&ModeWallops != 0 {
+			line.SendTo(p)
+		}
+	}
+	if len(s.Servers) > 0 {
+		s.propagate(sender, sender.Nick, "WALLOPS :%s", message)
+	}
+}
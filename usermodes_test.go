@@ -0,0 +1,111 @@
+package irc_go_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/fatlotus/fast-irc-golang"
+)
+
+func send(c *Client, format string, args ...interface{}) {
+	fmt.Fprintf(c.Writer, format+"\r\n", args...)
+	c.Writer.Flush()
+}
+
+// Reads up to the line containing substr, failing if any line before it
+// contains unwanted.
+func readUntilWithout(t *testing.T, c *Client, substr, unwanted string) string {
+	for {
+		line := readUntil(t, c, "")
+		if strings.Contains(line, substr) {
+			return line
+		}
+		if strings.Contains(line, unwanted) {
+			t.Errorf("unexpected %q before %q", line, substr)
+		}
+	}
+}
+
+func TestUserModes(t *testing.T) {
+	s := NewServer()
+	s.Opers = map[string]string{"root": "secret"}
+	s.LocalOpers = map[string]string{"local": "secret"}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewPipeClient("a", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewPipeClient("b", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// Known modes are applied even when others in the string aren't.
+	send(a, "MODE a +iwz")
+	readUntil(t, a, ":a MODE a :+iw")
+	readUntil(t, a, "501 a :Unknown MODE flag")
+	send(a, "MODE a")
+	readUntil(t, a, "221 a +iw")
+	send(a, "MODE b +i")
+	readUntil(t, a, "502 a :")
+	send(a, "MODE b")
+	readUntil(t, a, "502 a :")
+
+	// Invisible users are hidden from those outside their channels.
+	send(b, "MODE b +iB")
+	readUntil(t, b, ":b MODE b :+iB")
+	b.Join("#chan")
+	b.Writer.Flush()
+	readUntil(t, b, "366 b #chan")
+	send(a, "NAMES #chan")
+	readUntilWithout(t, a, "366 a #chan", "353")
+	send(a, "WHO #chan")
+	readUntilWithout(t, a, "315 a #chan", "352")
+	send(b, "WHO #chan")
+	if line := readUntil(t, b, "352"); !strings.Contains(line, " b HB@") {
+		t.Errorf("unexpected WHO reply %q", line)
+	}
+	send(a, "WHOIS b")
+	readUntil(t, a, "335 a b :is a bot")
+
+	// Dropping +o takes operator privileges with it.
+	send(a, "OPER root secret")
+	readUntil(t, a, "381 a")
+	send(a, "MODE a -o")
+	readUntil(t, a, ":a MODE a :-o")
+	send(a, "WALLOPS :hello")
+	readUntil(t, a, "481 a")
+
+	// Local operators may send WALLOPS, which only +w users receive.
+	send(b, "OPER local secret")
+	readUntil(t, b, "381 b")
+	send(b, "MODE b")
+	readUntil(t, b, "221 b +iOB")
+	send(b, "WALLOPS :hello")
+	readUntil(t, a, ":b!u@h WALLOPS :hello")
+	send(b, "MODE b")
+	readUntilWithout(t, b, "221 b", "WALLOPS")
+
+	// But nothing that affects the rest of the network.
+	for _, cmd := range []string{"CONNECT b.example", "SQUIT b.example", "DIE"} {
+		send(b, cmd)
+		readUntil(t, b, "481 b")
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Stop(context.Background())
+	}()
+	readUntil(t, a, "ERROR")
+	readUntil(t, b, "ERROR")
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+}
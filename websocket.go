@@ -0,0 +1,339 @@
+package irc_go
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// The subprotocols of the IRCv3 WebSocket spec. Each message carries one
+// line without its CRLF; over text.ircv3.net it must also be valid UTF-8.
+const (
+	TextSubprotocol   = "text.ircv3.net"
+	BinarySubprotocol = "binary.ircv3.net"
+)
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+
+	// Room for a line with the largest allowed tags.
+	wsMaxMessage = 8191 + 512
+)
+
+var errWebSocketProtocol = errors.New("irc: WebSocket protocol error")
+
+// Accepts WebSocket connections from browser clients and serves each as a
+// peer, so it can be mounted on any HTTP server, including the one serving
+// AdminHandler. A request arriving from one of the server's TrustedProxies
+// is attributed to the address in its X-Forwarded-For header.
+func (s *Server) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(s.serveWebSocket)
+}
+
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || key == "" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected a WebSocket handshake", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+
+	// Clients that name no subprotocol get text, as the spec suggests.
+	protocol, offered := "", false
+	for _, value := range r.Header["Sec-Websocket-Protocol"] {
+		for _, p := range strings.Split(value, ",") {
+			p = strings.TrimSpace(p)
+			offered = true
+			if protocol == "" && (p == TextSubprotocol || p == BinarySubprotocol) {
+				protocol = p
+			}
+		}
+	}
+	if offered && protocol == "" {
+		http.Error(w, "Unsupported subprotocol", http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Cannot take over the connection", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n")
+	if protocol != "" {
+		rw.WriteString("Sec-WebSocket-Protocol: " + protocol + "\r\n")
+	}
+	rw.WriteString("\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	ws := &wsConn{
+		Conn:   conn,
+		r:      rw.Reader,
+		binary: protocol == BinarySubprotocol,
+		remote: s.clientAddr(conn.RemoteAddr(), r.Header),
+	}
+	s.Attach(ws)
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h[name] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Works out the address of the client behind any trusted proxies, by walking
+// X-Forwarded-For from the nearest hop until an untrusted address.
+func (s *Server) clientAddr(addr net.Addr, h http.Header) net.Addr {
+	s.RLock()
+	trusted := s.TrustedProxies
+	s.RUnlock()
+
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok || !trusted.Contains(tcp.IP) {
+		return addr
+	}
+	hops := []string{}
+	for _, value := range h["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	client := tcp.IP
+	for i := len(hops) - 1; i >= 0 && trusted.Contains(client); i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		client = ip
+	}
+	return &net.TCPAddr{IP: client}
+}
+
+// Presents a WebSocket as a stream of CRLF-terminated lines, so that
+// HandleInput and the peer's output need no changes. Deadlines apply to
+// the underlying connection.
+type wsConn struct {
+	net.Conn
+	r      *bufio.Reader
+	binary bool
+	remote net.Addr
+
+	// Decoded input not yet returned by Read.
+	pending []byte
+
+	// Guards writes, which the reader makes too when answering pings.
+	mu      sync.Mutex
+	partial []byte
+	closed  bool
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = append(bytes.TrimRight(msg, "\r\n"), '\r', '\n')
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Reads frames until a whole data message has arrived, answering any
+// control frames along the way.
+func (c *wsConn) readMessage() ([]byte, error) {
+	msg := []byte(nil)
+	started := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.writeFrame(wsClose, payload)
+			return nil, io.EOF
+		case wsText, wsBinary:
+			if started {
+				return nil, c.fail(1002)
+			}
+			started = true
+		case wsContinuation:
+			if !started {
+				return nil, c.fail(1002)
+			}
+		default:
+			return nil, c.fail(1002)
+		}
+		if len(msg)+len(payload) > wsMaxMessage {
+			return nil, c.fail(1009)
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.r, head[:]); err != nil {
+		return
+	}
+	fin, opcode = head[0]&0x80 != 0, head[0]&0x0f
+	if head[0]&0x70 != 0 || head[1]&0x80 == 0 {
+		// Reserved bits are set, or the client didn't mask its frame.
+		err = c.fail(1002)
+		return
+	}
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > wsMaxMessage || opcode >= wsClose && (length > 125 || !fin) {
+		err = c.fail(1009)
+		return
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// Closes the WebSocket with the given status, returning the error that
+// ends the peer's input.
+func (c *wsConn) fail(status uint16) error {
+	var body [2]byte
+	binary.BigEndian.PutUint16(body[:], status)
+	c.writeFrame(wsClose, body[:])
+	return errWebSocketProtocol
+}
+
+// Sends each complete line written as a message of its own.
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data := b
+	if len(c.partial) > 0 {
+		data = append(c.partial, b...)
+	}
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimRight(data[:i], "\r")
+		data = data[i+1:]
+		opcode := byte(wsBinary)
+		if !c.binary {
+			opcode = wsText
+			if !utf8.Valid(line) {
+				line = bytes.ToValidUTF8(line, []byte("�"))
+			}
+		}
+		if err := c.sendFrame(opcode, line); err != nil {
+			return 0, err
+		}
+	}
+	c.partial = append(c.partial[:0], data...)
+	return len(b), nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.sendFrame(opcode, payload)
+}
+
+// Must be called with c.mu held.
+func (c *wsConn) sendFrame(opcode byte, payload []byte) error {
+	if c.closed {
+		return io.ErrClosedPipe
+	}
+	if opcode == wsClose {
+		c.closed = true
+	}
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	_, err := c.Conn.Write(append(frame, payload...))
+	return err
+}
+
+func (c *wsConn) Close() error {
+	c.writeFrame(wsClose, []byte{0x03, 0xe8})
+	return c.Conn.Close()
+}
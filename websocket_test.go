@@ -0,0 +1,150 @@
+package irc_go_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/fatlotus/fast-irc-golang"
+)
+
+type wsClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, addr, protocol, forwarded string) *wsClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\n"+
+		"Connection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n", addr)
+	if protocol != "" {
+		fmt.Fprintf(conn, "Sec-WebSocket-Protocol: %s\r\n", protocol)
+	}
+	if forwarded != "" {
+		fmt.Fprintf(conn, "X-Forwarded-For: %s\r\n", forwarded)
+	}
+	fmt.Fprintf(conn, "\r\n")
+
+	c := &wsClient{conn: conn, r: bufio.NewReader(conn)}
+	resp, err := http.ReadResponse(c.r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 101 {
+		t.Fatalf("unexpected status %s", resp.Status)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("unexpected accept key %q", accept)
+	}
+	// The server picks the first subprotocol it supports.
+	expected := strings.Split(protocol, ",")[0]
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != expected {
+		t.Errorf("expected subprotocol %q, got %q", expected, got)
+	}
+	return c
+}
+
+// Sends a masked frame, as clients must.
+func (c *wsClient) send(opcode byte, payload string) {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	c.conn.Write(frame)
+}
+
+func (c *wsClient) receive(t *testing.T) (byte, string) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	length := int(head[1] & 0x7f)
+	if length == 126 {
+		var ext [2]byte
+		io.ReadFull(c.r, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return head[0] & 0x0f, string(payload)
+}
+
+func (c *wsClient) receiveUntil(t *testing.T, substr string) (byte, string) {
+	for {
+		opcode, payload := c.receive(t)
+		if strings.Contains(payload, substr) {
+			return opcode, payload
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	s := NewServer()
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	s.TrustedProxies = CIDRList{loopback}
+	web := httptest.NewServer(s.WebSocketHandler())
+	defer web.Close()
+	addr := web.Listener.Addr().String()
+
+	a := dialWebSocket(t, addr, "", "")
+	a.send(1, "NICK a")
+	a.send(1, "USER a * * :a")
+	a.send(1, "JOIN #chan")
+	if opcode, line := a.receiveUntil(t, "JOIN #chan"); opcode != 1 || strings.Contains(line, "\r\n") {
+		t.Errorf("expected a text message without CRLF, got %d %q", opcode, line)
+	}
+
+	b := dialWebSocket(t, addr, "binary.ircv3.net, text.ircv3.net", "192.0.2.7, 10.1.1.1")
+	b.send(2, "NICK b\r\n")
+	b.send(2, "USER b * * :b")
+	b.send(2, "JOIN #chan")
+	b.receiveUntil(t, "JOIN #chan")
+	a.receiveUntil(t, "JOIN #chan")
+
+	// Invalid UTF-8 is replaced for text clients only.
+	b.send(2, "PRIVMSG #chan :caf\xe9")
+	if _, line := a.receiveUntil(t, "PRIVMSG"); !strings.HasSuffix(line, "caf�") {
+		t.Errorf("expected invalid UTF-8 to be replaced, got %q", line)
+	}
+	a.send(1, "PRIVMSG #chan :hi")
+	if opcode, line := b.receiveUntil(t, "PRIVMSG"); opcode != 2 || !strings.HasSuffix(line, ":hi") {
+		t.Errorf("expected a binary message, got %d %q", opcode, line)
+	}
+
+	a.send(9, "ping")
+	if opcode, payload := a.receiveUntil(t, "ping"); opcode != 10 {
+		t.Errorf("expected a pong, got %d %q", opcode, payload)
+	}
+
+	hosts := map[string]string{}
+	s.RLock()
+	for _, p := range s.Peers {
+		hosts[p.Nick] = p.Host
+	}
+	s.RUnlock()
+	if hosts["a"] != "127.0.0.1" || hosts["b"] != "10.1.1.1" {
+		t.Errorf("unexpected hosts %v", hosts)
+	}
+
+	b.send(8, "")
+	for {
+		if opcode, _ := b.receive(t); opcode == 8 {
+			break
+		}
+	}
+	a.receiveUntil(t, "QUIT")
+}